@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A record of a single SMS sent, or attempted, to a recipient
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Alert       string    `json:"alert"`
+	Fingerprint string    `json:"fingerprint"`
+	Team        string    `json:"team"`
+	Channel     string    `json:"channel"`
+	Recipient   string    `json:"recipient"`
+	MessageSid  string    `json:"message_sid,omitempty"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Code        string    `json:"code,omitempty"`
+}
+
+// Keep an audit trail of who was paged for what, either in the logs or in a JSON lines file
+type Auditor struct {
+	sink string
+	path string
+	mu   sync.Mutex
+}
+
+func newAuditor(sink string, path string) *Auditor {
+	return &Auditor{sink: sink, path: path}
+}
+
+// Hide most of a phone number's digits
+func maskPhone(number string) string {
+	if len(number) <= 5 {
+		return strings.Repeat("*", len(number))
+	}
+	return number[:3] + strings.Repeat("*", len(number)-5) + number[len(number)-2:]
+}
+
+// Record the outcome of sending the delivery's message to recipient
+func (auditor *Auditor) record(delivery Delivery, recipient string, sid string, err error) {
+	if auditor.sink == "" {
+		return
+	}
+
+	record := AuditRecord{
+		Time:        time.Now().UTC(),
+		Alert:       delivery.Alert,
+		Fingerprint: delivery.Fingerprint,
+		Team:        delivery.Team,
+		Channel:     delivery.Channel,
+		Recipient:   maskPhone(recipient),
+		MessageSid:  sid,
+		Status:      "sent",
+		Code:        delivery.Code,
+	}
+	if err != nil {
+		record.Status = "failed"
+		record.Error = err.Error()
+	}
+	auditor.write(record)
+}
+
+func (auditor *Auditor) write(record AuditRecord) {
+	if auditor.sink == "" {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot serialize audit record: %s", err.Error()))
+		return
+	}
+
+	if auditor.sink == "log" {
+		log.Printf("Audit: %s", line)
+		return
+	}
+
+	auditor.mu.Lock()
+	defer auditor.mu.Unlock()
+	// Reopened on each record so that the file can be rotated
+	file, err := os.OpenFile(auditor.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot open audit file: %s", err.Error()))
+		return
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot write audit record: %s", err.Error()))
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest request body read by default, Alertmanager notifications being far smaller
+const defaultMaxBodyBytes = 1 << 20
+
+// Tell whether reading a body failed because it is larger than allowed
+func bodyTooLarge(err error) bool {
+	// Older Go versions have no dedicated error type, only this message
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// Header holding the hex HMAC-SHA256 of a request's body, keyed with the webhook secret
+const signatureHeader = "X-Signature"
+
+// Header holding the Unix time a request to a management endpoint was signed at, signed along with its body
+const timestampHeader = "X-Signature-Timestamp"
+
+// How far from now the timestamp of a signed request to a management endpoint may be
+const signatureMaxAge = 5 * time.Minute
+
+// Tell whether signature is body's HMAC-SHA256 with secret, in constant time
+func validSignature(secret string, body []byte, signature string) bool {
+	expected := hmac.New(sha256.New, []byte(secret))
+	expected.Write(body)
+	given, err := hex.DecodeString(signature)
+	return err == nil && hmac.Equal(given, expected.Sum(nil))
+}
+
+// Tell whether the request carries the expected basic auth credentials, comparing both in constant time
+func validBasicAuth(r *http.Request, user string, password string) bool {
+	givenUser, givenPassword, ok := r.BasicAuth()
+	userMatch := subtle.ConstantTimeCompare([]byte(givenUser), []byte(user))
+	passwordMatch := subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password))
+	return ok && userMatch&passwordMatch == 1
+}
+
+// Parse an already validated comma-separated list of CIDRs
+func parseCidrs(value string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range parseList(value) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// Get the IP a request comes from, the one the proxy in front of the service saw when it is trusted
+func (serv *Server) clientIP(r *http.Request) net.IP {
+	if serv.trustedProxy {
+		// The last address is the one appended by the proxy, the previous ones may be forged by the client
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := net.ParseIP(strings.TrimSpace(forwarded[len(forwarded)-1])); ip != nil {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// Tell whether the request comes from one of the allowed networks, any request being allowed when there are none
+func (serv *Server) allowedSource(w http.ResponseWriter, r *http.Request) bool {
+	if len(serv.allowedNetworks) == 0 {
+		return true
+	}
+	ip := serv.clientIP(r)
+	for _, network := range serv.allowedNetworks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	log.Printf("Rejecting request from %s to %s, not in the allowed networks", ip, r.URL.Path)
+	asJson(w, http.StatusForbidden, "forbidden source address")
+	return false
+}
+
+// Read a request's body, rejecting the request when it lacks the configured basic auth credentials or signature, or is too large
+func (serv *Server) readAuthenticatedBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	return serv.readCheckedBody(w, r, func(body []byte) error {
+		if !validSignature(serv.webhookSecret, body, r.Header.Get(signatureHeader)) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	})
+}
+
+// Read the body of a request to a management endpoint like readAuthenticatedBody, its signature covering
+// a recent timestamp and being accepted once, so that a signed request, e.g. the empty body of a GET, cannot be replayed
+func (serv *Server) readManagementBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	return serv.readCheckedBody(w, r, func(body []byte) error {
+		return serv.checkFreshSignature(r, body)
+	})
+}
+
+// Check that the request's signature is of its timestamp and body, that the timestamp is recent and the signature new
+func (serv *Server) checkFreshSignature(r *http.Request, body []byte) error {
+	timestamp := r.Header.Get(timestampHeader)
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid signature timestamp")
+	}
+	if age := time.Since(time.Unix(signedAt, 0)); age > signatureMaxAge || age < -signatureMaxAge {
+		return errors.New("stale signature timestamp")
+	}
+	signature := r.Header.Get(signatureHeader)
+	if !validSignature(serv.webhookSecret, append([]byte(timestamp+"."), body...), signature) {
+		return errors.New("invalid signature")
+	}
+	// Signatures are remembered for as long as their timestamp is accepted
+	if serv.seenSignatures.Add(signature, true, 2*signatureMaxAge) != nil {
+		return errors.New("replayed signature")
+	}
+	return nil
+}
+
+// Read a request's body, rejecting the request when it lacks the configured basic auth credentials,
+// when checkSignature fails while a webhook secret is set, or when it is too large
+func (serv *Server) readCheckedBody(w http.ResponseWriter, r *http.Request, checkSignature func(body []byte) error) ([]byte, bool) {
+	if serv.basicAuthUser != "" && !validBasicAuth(r, serv.basicAuthUser, serv.basicAuthPassword) {
+		log.Printf("Rejecting request from %s to %s with invalid credentials", r.RemoteAddr, r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Basic realm="alertmanager-twilio-gsheets", charset="UTF-8"`)
+		asJson(w, http.StatusUnauthorized, "invalid credentials")
+		return nil, false
+	}
+
+	// The signature is checked on the limited body too, nothing is read past the limit
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, serv.maxBodyBytes))
+	if bodyTooLarge(err) {
+		logMessage(fmt.Sprintf("Rejecting request from %s to %s with a body larger than %d bytes", r.RemoteAddr, r.URL.Path, serv.maxBodyBytes))
+		asJson(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body larger than %d bytes", serv.maxBodyBytes))
+		return nil, false
+	}
+	if err != nil {
+		logMessage(fmt.Sprintf("Error reading request body: %s", err.Error()))
+		asJson(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	if serv.webhookSecret != "" {
+		if err := checkSignature(body); err != nil {
+			log.Printf("Rejecting request from %s to %s with %s", r.RemoteAddr, r.URL.Path, err.Error())
+			asJson(w, http.StatusUnauthorized, err.Error())
+			return nil, false
+		}
+	}
+	return body, true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func newRefreshTestServer() *Server {
+	serv := newTeamsTestServer(false)
+	serv.webhookSecret = "secret"
+	serv.maxBodyBytes = defaultMaxBodyBytes
+	serv.seenSignatures = cache.New(2*signatureMaxAge, 0)
+	return serv
+}
+
+// Build a request to /refresh signed at signedAt
+func signedRefresh(signedAt time.Time) *http.Request {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "."))
+	r := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	r.Header.Set(timestampHeader, timestamp)
+	r.Header.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestRefreshRejectsReplayedRequest(t *testing.T) {
+	serv := newRefreshTestServer()
+	signed := signedRefresh(time.Now())
+
+	w := httptest.NewRecorder()
+	serv.refresh(w, signed)
+	if w.Code != http.StatusOK {
+		t.Fatalf("signed refresh answered %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	// The very same request sent again, e.g. by someone who saw it go by
+	replayed := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	replayed.Header = signed.Header.Clone()
+	w = httptest.NewRecorder()
+	serv.refresh(w, replayed)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed refresh answered %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRefreshRejectsStaleOrUnsignedTimestamp(t *testing.T) {
+	serv := newRefreshTestServer()
+
+	w := httptest.NewRecorder()
+	serv.refresh(w, signedRefresh(time.Now().Add(-2*signatureMaxAge)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("refresh signed long ago answered %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Signed the way webhook requests are, the timestamp being left out of the signature
+	r := signedRefresh(time.Now())
+	r.Header.Set(signatureHeader, hex.EncodeToString(hmac.New(sha256.New, []byte("secret")).Sum(nil)))
+	w = httptest.NewRecorder()
+	serv.refresh(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("refresh signed without its timestamp answered %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Team lookups counted by result since startup, the same as sheet_cache_lookups_total
+type LookupCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// What a cache holds and how long its items are kept
+type CacheSummary struct {
+	Items int    `json:"items"`
+	TTL   string `json:"ttl"`
+}
+
+type CacheStats struct {
+	Short    CacheSummary   `json:"short"`
+	Fallback CacheSummary   `json:"fallback"`
+	Unknown  CacheSummary   `json:"unknown"`
+	Lookups  map[string]int `json:"lookups"`
+}
+
+// Count a team lookup by its result, for metrics and the cache statistics
+func (serv *Server) countLookup(result string) {
+	sheetCacheLookups.WithLabelValues(result).Inc()
+	serv.lookups.mu.Lock()
+	defer serv.lookups.mu.Unlock()
+	serv.lookups.counts[result]++
+}
+
+func summarizeCache(items *cache.Cache, ttl time.Duration) CacheSummary {
+	summary := CacheSummary{Items: items.ItemCount(), TTL: "never expires"}
+	if ttl > 0 {
+		summary.TTL = ttl.String()
+	}
+	return summary
+}
+
+// Tell how many teams the caches hold and how lookups went, to tune their TTLs
+func (serv *Server) cacheStats(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet {
+		asJson(w, http.StatusMethodNotAllowed, "unsupported HTTP method")
+		return
+	}
+
+	if _, ok := serv.readManagementBody(w, r); !ok {
+		return
+	}
+
+	stats := CacheStats{
+		Short:    summarizeCache(serv.shortCache, shortCacheTTL),
+		Fallback: summarizeCache(serv.longCache, 0),
+		Unknown:  summarizeCache(serv.unknownTeams, unknownTeamTTL),
+		Lookups:  map[string]int{"hit": 0, "miss": 0, "fallback": 0, "unknown": 0},
+	}
+	serv.lookups.mu.Lock()
+	for result, count := range serv.lookups.counts {
+		stats.Lookups[result] = count
+	}
+	serv.lookups.mu.Unlock()
+	asJson(w, http.StatusOK, stats)
+}
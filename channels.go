@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How a channel retries its sends and how long each attempt may take
+type ChannelSettings struct {
+	Retries    int
+	RetryDelay time.Duration
+	Timeout    time.Duration
+	// Client of the channels sending over HTTP, its timeout being Timeout
+	Client *http.Client
+}
+
+// Parse a channel's retries, base retry delay and timeout parameters, falling back to defaults when unset
+func parseChannelSettings(retries string, retryDelay string, timeout string, defaults ChannelSettings, transport http.RoundTripper) ChannelSettings {
+	settings := ChannelSettings{
+		Retries:    parseUint(retries, defaults.Retries),
+		RetryDelay: parseDuration(retryDelay, defaults.RetryDelay),
+		Timeout:    parseDuration(timeout, defaults.Timeout),
+	}
+	settings.Client = &http.Client{Timeout: settings.Timeout, Transport: transport}
+	return settings
+}
+
+// Get the settings of a channel, unknown channels going by the SMS ones
+func (serv *Server) channelSettings(channel string) ChannelSettings {
+	if settings, found := serv.channels[channel]; found {
+		return settings
+	}
+	return serv.channels["sms"]
+}
+
+// Make a request, retrying it as settings say while it fails with an error that may go away
+func retrying(ctx context.Context, settings ChannelSettings, action string, target string, request func() (string, error)) (string, error) {
+	for attempt := 0; ; attempt++ {
+		sid, err := request()
+		if err == nil {
+			return sid, nil
+		}
+
+		delay, retry := retryDelay(err, attempt, settings.RetryDelay)
+		if !retry || attempt >= settings.Retries {
+			return sid, err
+		}
+		log.Printf("%s %s again in %s (retry %d of %d)", action, target, delay.Round(time.Millisecond), attempt+1, settings.Retries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return sid, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/prometheus/alertmanager/template"
+)
+
+// A recipient reached through a channel, alerts sent through different channels cannot be merged
+type channelRecipient struct {
+	recipient string
+	channel   string
+}
+
+// Process every alert of a notification, sending each recipient a single message gathering all of its alerts
+func (serv *Server) processCoalesced(ctx context.Context, alerts template.Data) Report {
+	report := newReport()
+	var planned []template.Alert
+	var deliveries []Delivery
+	var recipients []channelRecipient
+	byRecipient := make(map[channelRecipient][]Delivery)
+	for _, alert := range alerts.Alerts {
+		if serv.holdFlapping(alert, alerts.Receiver) {
+			report.skip(alert, Delivery{}, heldReason(alert))
+			continue
+		}
+		if serv.skipResolved(alert) {
+			report.skip(alert, Delivery{}, errResolvedSkipped)
+			continue
+		}
+		serv.logAlert(alert, alerts.Receiver)
+
+		delivery, err := serv.planDelivery(ctx, alert, alerts.Receiver)
+		if err != nil {
+			report.add(alert, delivery, false, err)
+			continue
+		}
+		if delivery.Channel == "none" {
+			log.Printf("Not sending alert %s, its severity's policy drops it", delivery.Alert)
+			report.skip(alert, delivery, errDropped)
+			continue
+		}
+		if !serv.withinTeamRateLimit(delivery.Team) {
+			report.skip(alert, delivery, errRateLimited)
+			continue
+		}
+		delivery = serv.correlate(delivery)
+		serv.announceBroadcast(delivery)
+		serv.notifyOthers(ctx, delivery)
+		if serv.perAlertTeams[serv.teamKey(delivery.Team)] {
+			sent, suppressed, deduplicated, errs := serv.notify(ctx, delivery)
+			report.Deduplicated += deduplicated
+			if allSuppressed(sent, suppressed, errs) {
+				report.skip(alert, delivery, serv.suppressAlert(delivery))
+				continue
+			}
+			var err error
+			if len(errs) > 0 {
+				err = errs[0]
+			}
+			delivered, deduplicated, err := serv.escalateUnreached(ctx, delivery, sent > 0, err)
+			report.Deduplicated += deduplicated
+			report.add(alert, delivery, delivered, err)
+			continue
+		}
+		planned = append(planned, alert)
+		deliveries = append(deliveries, delivery)
+		for _, number := range appendUnique(delivery.Recipients, delivery.CC...) {
+			recipient := channelRecipient{number, delivery.Channel}
+			if _, found := byRecipient[recipient]; !found {
+				recipients = append(recipients, recipient)
+			}
+			byRecipient[recipient] = append(byRecipient[recipient], delivery)
+		}
+	}
+
+	header := serv.commonHeader(alerts.CommonLabels)
+	reached := make(map[string]bool)
+	failures := make(map[string]error)
+	// Recipients not only suppressed on purpose, through one channel or another
+	unsuppressed := make(map[string]bool)
+	for _, recipient := range recipients {
+		sent, suppressed, deduplicated, errs := serv.notify(ctx, serv.mergeDeliveries(recipient.recipient, header, byRecipient[recipient]))
+		report.Deduplicated += deduplicated
+		reached[recipient.recipient] = reached[recipient.recipient] || sent > 0
+		unsuppressed[recipient.recipient] = unsuppressed[recipient.recipient] || !allSuppressed(sent, suppressed, errs)
+		if len(errs) > 0 && failures[recipient.recipient] == nil {
+			failures[recipient.recipient] = errs[0]
+		}
+	}
+
+	// Like for single alerts, escalate the ones none of the recipients could be reached for, unless they were all suppressed
+	for i, delivery := range deliveries {
+		if len(delivery.Recipients) > 0 && !anyReached(delivery.Recipients, unsuppressed) {
+			report.skip(planned[i], delivery, serv.suppressAlert(delivery))
+			continue
+		}
+		delivered, deduplicated, err := serv.escalateUnreached(ctx, delivery, anyReached(delivery.Recipients, reached), firstFailure(delivery.Recipients, failures))
+		report.Deduplicated += deduplicated
+		report.add(planned[i], delivery, delivered, err)
+	}
+	return report
+}
+
+// Escalate a delivery none of the recipients could be reached for, returns whether someone was reached and the error met
+func (serv *Server) escalateUnreached(ctx context.Context, delivery Delivery, delivered bool, err error) (bool, int, error) {
+	if delivered || serv.escalationTeam == "" || serv.escalationTeam == delivery.Team {
+		return delivered, 0, err
+	}
+	sent, deduplicated, errs := serv.escalate(ctx, delivery)
+	if len(errs) > 0 {
+		return sent > 0, deduplicated, errs[0]
+	}
+	return sent > 0, deduplicated, nil
+}
+
+// Describe the context shared by a notification's alerts from the configured common labels
+func (serv *Server) commonHeader(labels template.KV) string {
+	var pairs []string
+	for _, name := range serv.commonLabels {
+		if value := labels[name]; value != "" {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Merge the deliveries of a recipient into a single one
+func (serv *Server) mergeDeliveries(recipient string, header string, deliveries []Delivery) Delivery {
+	if len(deliveries) == 1 {
+		merged := deliveries[0]
+		merged.Recipients = []string{recipient}
+		merged.CC = nil
+		return merged
+	}
+
+	var alerts, fingerprints, teams, messages, codes []string
+	maxLength := deliveries[0].MaxLength
+	call := false
+	for _, delivery := range deliveries {
+		call = call || delivery.Call
+		if delivery.MaxLength < maxLength {
+			maxLength = delivery.MaxLength
+		}
+		if delivery.Code != "" {
+			codes = append(codes, delivery.Code)
+		}
+		alerts = append(alerts, delivery.Alert)
+		fingerprints = append(fingerprints, delivery.Fingerprint)
+		teams = append(teams, delivery.Team)
+		messages = append(messages, delivery.Message)
+	}
+	merged := Delivery{
+		Alert:       strings.Join(alerts, ","),
+		Fingerprint: strings.Join(fingerprints, ","),
+		Team:        strings.Join(teams, ","),
+		Channel:     deliveries[0].Channel,
+		Env:         deliveries[0].Env,
+		Recipients:  []string{recipient},
+		Code:        strings.Join(codes, ","),
+		MaxLength:   maxLength,
+		Call:        call,
+	}
+	merged.Message = combineMessages(header, messages, serv.messageRoom(merged))
+	return merged
+}
+
+func anyReached(recipients []string, reached map[string]bool) bool {
+	for _, recipient := range recipients {
+		if reached[recipient] {
+			return true
+		}
+	}
+	return false
+}
+
+func firstFailure(recipients []string, failures map[string]error) error {
+	for _, recipient := range recipients {
+		if err, found := failures[recipient]; found {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The columns holding teams and their phone numbers, found by their names in the header row
+type namedColumns struct {
+	team   int
+	phones []int
+}
+
+// Find the configured team and phone number columns in the header row, nil when columns are not named
+func (serv *Server) findColumns(header map[int]string) (*namedColumns, error) {
+	if serv.teamColumn == "" {
+		return nil, nil
+	}
+
+	indexes := make(map[string]int)
+	for index, name := range header {
+		// Like tiers, names may be shared, the first column having a name holds it
+		if current, found := indexes[name]; !found || index < current {
+			indexes[name] = index
+		}
+	}
+
+	var columns namedColumns
+	var missing []string
+	team, found := indexes[serv.teamColumn]
+	if !found {
+		missing = append(missing, serv.teamColumn)
+	}
+	columns.team = team
+	for _, name := range serv.phoneColumns {
+		phone, found := indexes[name]
+		if !found {
+			missing = append(missing, name)
+			continue
+		}
+		columns.phones = append(columns.phones, phone)
+	}
+	if len(missing) > 0 {
+		return nil, &SheetError{Message: fmt.Sprintf("Cannot read Sheet - header row %d has no \"%s\" column", serv.headerRow, strings.Join(missing, "\", \""))}
+	}
+	return &columns, nil
+}
+
+// Get the team name of a row, read from the range's first column unless columns are named
+func (serv *Server) rowName(row []interface{}, columns *namedColumns) string {
+	if columns == nil {
+		return fmt.Sprint(row[0])
+	}
+	return serv.rowCell(row, columns.team)
+}
+
+// Get the phone numbers of a row from the named phone number columns, in their configured order
+func (serv *Server) namedNumbers(row []interface{}, columns *namedColumns) []interface{} {
+	var numbers []interface{}
+	for _, column := range columns.phones {
+		if value := serv.rowCell(row, column); value != "" {
+			numbers = append(numbers, value)
+		}
+	}
+	return numbers
+}
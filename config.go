@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// What the validation rules of parameters require, for the rules without parameters
+var ruleDescriptions = map[string]string{
+	"required":         "is required",
+	"boolean":          "must be true or false",
+	"uint":             "must be a positive integer or 0",
+	"ratio":            "must be a number between 0 and 1",
+	"duration":         "must be a duration e.g. 30s or 5m",
+	"url":              "must be a URL e.g. https://example.com/path",
+	"email":            "must be an email address",
+	"json":             "must be valid JSON",
+	"file":             "must be an existing file",
+	"port":             "must be a port number between 0 and 65535",
+	"hostname|ip":      "must be a hostname or an IP address",
+	"iso3166_1_alpha2": "must be a two-letter country code e.g. FR",
+	"phone":            "must be a valid E.164 phone number e.g. +33611111111",
+	"phones":           "must be comma-separated E.164 phone numbers e.g. +33611111111,+33622222222",
+	"twiliosid":        "must be a twilio SID, two capital letters followed by 32 hexadecimal characters",
+	"messagingsid":     "must be a twilio Messaging Service SID, MG followed by 32 hexadecimal characters",
+	"sheetids":         "must be a spreadsheet ID, or comma-separated env=ID spreadsheets with at most one of them without env",
+	"sheetrange":       "must be a range of columns e.g. A2:D",
+	"a1range":          "must be a cell in A1 notation e.g. Settings!B1",
+	"column":           "must be a column letter e.g. C",
+	"countrycodes":     "must be comma-separated country calling codes e.g. 33,44",
+	"cidrs":            "must be comma-separated IP addresses or CIDR ranges e.g. 10.0.0.0/8,192.168.1.10",
+	"basepath":         "must be a path e.g. /alerts",
+	"labelname":        "must be a Prometheus label name e.g. service",
+	"timezone":         "must be a time zone name e.g. Europe/Paris",
+	"gotemplate":       "must be a valid Go template",
+	"stringmap":        "must be a JSON object of strings",
+	"sentrydsn":        "must be a valid Sentry DSN",
+	"severitypolicies": "must be a JSON object of severity policies, using enabled channels and valid columns",
+	"callable":         "cannot be enabled without TWILIO_FROM_NUMBER, calls cannot go through a Messaging Service",
+	"authenticated":    "cannot be enabled without WEBHOOK_BASIC_AUTH_USER or WEBHOOK_SECRET",
+}
+
+// Read the parameters from the environment variables named by the env tags of Config
+func readConfig() Config {
+	var config Config
+	fields := reflect.ValueOf(&config).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		fields.Field(i).SetString(os.Getenv(fields.Type().Field(i).Tag.Get("env")))
+	}
+	return config
+}
+
+// Get the environment variable of a Config field
+func configEnv(field string) string {
+	if structField, found := reflect.TypeOf(Config{}).FieldByName(field); found {
+		return structField.Tag.Get("env")
+	}
+	return field
+}
+
+// Get the environment variables of a rule's space-separated Config fields
+func configEnvs(fields string) string {
+	var envs []string
+	for _, field := range strings.Fields(fields) {
+		envs = append(envs, configEnv(field))
+	}
+	return strings.Join(envs, " or ")
+}
+
+// Tell what is wrong with a parameter in words, naming its environment variable
+func describeConfigError(e validator.FieldError) string {
+	env := configEnv(e.StructField())
+	param := e.Param()
+	var description string
+	switch e.Tag() {
+	case "oneof":
+		description = "must be one of " + strings.Join(strings.Fields(param), ", ")
+	case "min":
+		description = fmt.Sprintf("must be at least %s characters long", param)
+	case "max":
+		description = fmt.Sprintf("must be at most %s characters long", param)
+	case "ne":
+		description = fmt.Sprintf("must not be %s", param)
+	case "contains":
+		description = fmt.Sprintf("must contain %s", param)
+	case "smslength":
+		description = fmt.Sprintf("must be a number of characters between %d and %d", minMessageLength, maxMessageLength)
+	case "required_with":
+		description = fmt.Sprintf("is required when %s is set", configEnvs(param))
+	case "required_without":
+		description = fmt.Sprintf("is required unless %s is set", configEnvs(param))
+	case "excluded_with":
+		description = fmt.Sprintf("cannot be set along with %s", configEnvs(param))
+	case "required_if":
+		fields := strings.Fields(param)
+		description = fmt.Sprintf("is required when %s is %s", configEnv(fields[0]), strings.Join(fields[1:], " "))
+	default:
+		var found bool
+		description, found = ruleDescriptions[e.Tag()]
+		if !found {
+			description = fmt.Sprintf("does not pass the %s rule", e.Tag())
+		}
+	}
+	return env + " " + description
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"log"
+)
+
+// Crockford's alphabet, without letters easily mistaken for digits when read out loud
+var correlationEncoding = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+// Length of correlation codes, about a billion of them
+const correlationCodeLength = 6
+
+func newCorrelationCode() string {
+	random := make([]byte, 4)
+	_, _ = rand.Read(random)
+	return correlationEncoding.EncodeToString(random)[:correlationCodeLength]
+}
+
+// Give the delivery a correlation code to reference the page by, when enabled
+func (serv *Server) correlate(delivery Delivery) Delivery {
+	if !serv.correlationCodes {
+		return delivery
+	}
+
+	delivery.Code = newCorrelationCode()
+	delivery.Message = truncate("#"+delivery.Code+" "+delivery.Message, serv.messageRoom(delivery))
+	log.Printf("Correlation code %s: %s alert %s (%s) for team \"%s\"", delivery.Code, delivery.Status, delivery.Alert, delivery.Fingerprint, delivery.Team)
+	return delivery
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+)
+
+// How long a message sent to a recipient is not sent to them again
+const defaultDedupWindow = 5 * time.Minute
+
+// Get the key identifying a message sent to recipient, correlation codes aside as they differ every time
+func dedupKey(delivery Delivery, recipient string) string {
+	message := delivery.Message
+	if delivery.Code != "" {
+		message = strings.TrimPrefix(message, "#"+delivery.Code+" ")
+	}
+	hash := sha256.Sum256([]byte(delivery.Channel + "|" + recipient + "|" + message))
+	return hex.EncodeToString(hash[:])
+}
+
+// Remember the delivery's message is being sent to recipient, returns true when it already was within the window
+func (serv *Server) duplicate(delivery Delivery, recipient string) bool {
+	if serv.dedupWindow <= 0 {
+		return false
+	}
+	if serv.dedupCache.Add(dedupKey(delivery, recipient), true, serv.dedupWindow) == nil {
+		return false
+	}
+	smsSuppressed.WithLabelValues("duplicate").Inc()
+	log.Printf("Not sending alert %s to %s again, the same message was sent less than %s ago", delivery.Alert, maskPhone(recipient), serv.dedupWindow)
+	return true
+}
+
+// Forget about a message that could not be sent to recipient, so that it can be sent again
+func (serv *Server) forgetSent(delivery Delivery, recipient string) {
+	if serv.dedupWindow > 0 {
+		serv.dedupCache.Delete(dedupKey(delivery, recipient))
+	}
+}
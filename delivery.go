@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Recipients an alert is sent to at most unless MAX_RECIPIENTS_PER_ALERT is set, against runaway sends from bad data
+const defaultMaxRecipients = 20
+
+// What is sent for an alert, and to whom
+type Delivery struct {
+	Alert       string `json:"alert"`
+	Fingerprint string `json:"fingerprint"`
+	Status      string `json:"status"`
+	Team        string `json:"team"`
+	Severity    string `json:"severity,omitempty"`
+	// Env of the spreadsheet the teams were read from, when several are set
+	Env        string   `json:"env,omitempty"`
+	Channel    string   `json:"channel"`
+	Message    string   `json:"message"`
+	Recipients []string `json:"recipients"`
+	CC         []string `json:"cc,omitempty"`
+	Code       string   `json:"code,omitempty"`
+	MaxLength  int      `json:"max_length"`
+	// Whether recipients are also called, on top of the channel's message
+	Call bool `json:"call,omitempty"`
+	// Team also paged because the emergency override is on
+	Broadcast string `json:"broadcast,omitempty"`
+}
+
+// Find the alert's recipients and render its message, without sending anything
+func (serv *Server) planDelivery(ctx context.Context, alert template.Alert, receiver string) (Delivery, error) {
+	teams := serv.routingTeams(serv.alertTeam(alert))
+	spreadsheet := serv.alertSpreadsheet(alert)
+	delivery := Delivery{
+		Alert:       alert.Labels["alertname"],
+		Fingerprint: alertKey(alert),
+		Status:      alert.Status,
+		Team:        strings.Join(teams, ","),
+		Severity:    alert.Labels["severity"],
+		Env:         spreadsheet.Env,
+		Channel:     serv.messageChannel(alert),
+		MaxLength:   serv.maxLength,
+	}
+	policy, hasPolicy := serv.severityPolicy(alert.Labels["severity"])
+	if hasPolicy {
+		delivery.Channel = policy.Channel
+	}
+	// Nobody needs waking up for a resolved alert
+	if delivery.Channel == "call" && alert.Status != "firing" {
+		delivery.Channel = serv.messageChannel(alert)
+	}
+	delivery.Call = delivery.Channel != "call" && delivery.Channel != "none" && serv.wantsCall(alert)
+
+	labelNumbers, err := getPhonesFromLabel(alert.Labels["phone_numbers"], serv.phoneRegion)
+	if err != nil {
+		serv.logAlertMessage(alert, fmt.Sprintf("Cannot use label-provided phone numbers %s: %s", alert.Labels["phone_numbers"], err.Error()))
+	}
+
+	fromLabel := labelNumbers != nil
+	var recipients []interface{}
+	var teamText *Team
+	// Label numbers replace the team's unless they are appended to them, for alerts having a team
+	if !fromLabel || (serv.appendLabelNumbers && serv.alertTeam(alert) != "") {
+		var lookupErr error
+		for _, name := range teams {
+			team, err := serv.teamOrDefault(ctx, spreadsheet, name)
+			if err != nil {
+				serv.logAlertMessage(alert, err.Error())
+				lookupErr = err
+				continue
+			}
+			numbers := team.Numbers
+			if hasPolicy && len(policy.Columns) > 0 {
+				numbers = team.numbersIn(policy.Columns)
+			}
+			if tier := alert.Labels[tierLabel]; tier != "" {
+				numbers = serv.tierNumbers(name, team, tier, numbers)
+			}
+			recipients = append(recipients, numbers...)
+			// Messages must fit the most constrained of the teams' phones
+			if team.MaxLength > 0 && team.MaxLength < delivery.MaxLength {
+				delivery.MaxLength = team.MaxLength
+			}
+			// Several teams' headers and footers cannot all fit in a message
+			if len(teams) == 1 {
+				teamText = &team
+			}
+		}
+		// The alert can still go to the teams that were found, or to its label numbers
+		if recipients == nil && lookupErr != nil && !fromLabel {
+			return delivery, lookupErr
+		}
+	}
+	// Past the team's numbers, so that the recipients cap drops label numbers first
+	recipients = append(recipients, labelNumbers...)
+
+	// Messages are composed once the most constrained of the teams is known
+	room := serv.messageRoom(delivery)
+	message, err := serv.composeMessage(newTemplateData(alert, receiver, delivery.Team), serv.teamMessageTemplate(teamText), room)
+	if err != nil {
+		serv.logAlertMessage(alert, err.Error())
+		return delivery, err
+	}
+	if teamText != nil {
+		message = withTeamText(message, *teamText, room)
+	}
+	delivery.Message = message
+	delivery.Recipients = serv.formatRecipients(delivery.Team, recipients)
+	if fromLabel && len(serv.labelCountryCodes) > 0 {
+		for _, recipient := range serv.formatRecipients(delivery.Team, labelNumbers) {
+			code := countryCode(recipient)
+			if !serv.labelCountryCodes[code] {
+				err := errors.New(fmt.Sprintf("Label-provided phone number %s has country code %d, which is not allowed", maskPhone(recipient), code))
+				serv.logAlertMessage(alert, err.Error())
+				return delivery, err
+			}
+		}
+	}
+
+	if serv.maxRecipients > 0 && len(delivery.Recipients) > serv.maxRecipients {
+		message := fmt.Sprintf("Alert %s has %d recipients, more than MAX_RECIPIENTS_PER_ALERT allows (%d)", delivery.Alert, len(delivery.Recipients), serv.maxRecipients)
+		if serv.strictRecipients {
+			err := errors.New(message)
+			serv.logAlertMessage(alert, err.Error())
+			return delivery, err
+		}
+		serv.logAlertMessage(alert, fmt.Sprintf("%s, only sending to the first %d", message, serv.maxRecipients))
+		delivery.Recipients = delivery.Recipients[:serv.maxRecipients]
+	}
+
+	if broadcast := serv.broadcastRecipients(ctx, spreadsheet); broadcast != nil {
+		delivery.Broadcast = serv.broadcastTeam
+		delivery.Recipients = appendUnique(delivery.Recipients, broadcast...)
+	}
+	for _, number := range serv.ccNumbers {
+		if !contains(delivery.Recipients, number) {
+			delivery.CC = append(delivery.CC, number)
+		}
+	}
+	return delivery, nil
+}
+
+// Get the channel twilio messages of an alert go through, its channel label overriding DELIVERY_CHANNEL
+func (serv *Server) messageChannel(alert template.Alert) string {
+	label, found := alert.Labels["channel"]
+	if !found {
+		return serv.deliveryChannel
+	}
+	if label = strings.ToLower(strings.TrimSpace(label)); label == "sms" || label == "whatsapp" {
+		return label
+	}
+	log.Printf("Ignoring invalid channel label \"%s\" of alert %s", label, alert.Labels["alertname"])
+	return serv.deliveryChannel
+}
+
+// Tell whether channel sends messages through twilio, as SMS or WhatsApp messages
+func twilioMessaging(channel string) bool {
+	return channel == "sms" || channel == "whatsapp"
+}
+
+// Get a team's row, or the default team's when the team cannot be found
+func (serv *Server) teamOrDefault(ctx context.Context, spreadsheet Spreadsheet, name string) (Team, error) {
+	team, err := serv.getTeamNumbers(ctx, spreadsheet, name)
+	if err == nil || serv.defaultTeam == "" || name == serv.defaultTeam {
+		return team, err
+	}
+
+	defaultTeam, defaultErr := serv.getTeamNumbers(ctx, spreadsheet, serv.defaultTeam)
+	if defaultErr != nil {
+		return team, err
+	}
+	logMessage(fmt.Sprintf("%s, sending to default team %s instead", err.Error(), serv.defaultTeam))
+	return defaultTeam, nil
+}
+
+// Append values to list, skipping the ones already in it
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		if !contains(list, value) {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+func contains(list []string, value string) bool {
+	for _, existing := range list {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the value of the alert's label looked up in the Sheet, its team label unless LOOKUP_LABEL is set
+func (serv *Server) alertTeam(alert template.Alert) string {
+	return alert.Labels[serv.lookupLabel]
+}
+
+// Get the teams an alert is routed to from its team label, split it when it may hold several of them
+func (serv *Server) routingTeams(label string) []string {
+	if serv.teamSeparator == "" {
+		return []string{serv.canonicalTeam(label)}
+	}
+
+	var teams []string
+	for _, team := range strings.Split(label, serv.teamSeparator) {
+		if team = strings.TrimSpace(team); team != "" {
+			teams = appendUnique(teams, serv.canonicalTeam(team))
+		}
+	}
+	if len(teams) == 0 {
+		return []string{serv.canonicalTeam(label)}
+	}
+	return teams
+}
+
+// Translate a team label into the team's name in the Sheet
+func (serv *Server) canonicalTeam(team string) string {
+	if canonical, found := serv.teamAliases[serv.teamKey(team)]; found {
+		log.Printf("Team \"%s\" is an alias of team \"%s\"", team, canonical)
+		return canonical
+	}
+	return team
+}
+
+func (serv *Server) logAlert(alert template.Alert, receiver string) {
+	if serv.receiverInLogs {
+		log.Printf("Processing %s alert %s for team \"%s\" from receiver %s", alert.Status, alert.Labels["alertname"], serv.alertTeam(alert), receiver)
+	}
+}
+
+// Returned for alerts not sent on purpose
+var errDropped = errors.New("Alert dropped by its severity's policy")
+
+// Returned for resolved alerts when they are not notified
+var errResolvedSkipped = errors.New("Resolved alerts are not notified")
+
+// Tell whether an alert is left out for being resolved, before looking up its recipients
+func (serv *Server) skipResolved(alert template.Alert) bool {
+	if serv.notifyOnResolved || alert.Status != "resolved" {
+		return false
+	}
+	log.Printf("Not sending alert %s, resolved alerts are not notified", alert.Labels["alertname"])
+	return true
+}
+
+// Find the alert's recipients and send them its message, returns the delivery, the number of messages sent and the first error met
+func (serv *Server) processAlert(ctx context.Context, alert template.Alert, receiver string) (Delivery, int, int, error) {
+	serv.logAlert(alert, receiver)
+
+	delivery, err := serv.planDelivery(ctx, alert, receiver)
+	if err != nil {
+		return delivery, 0, 0, err
+	}
+	if delivery.Channel == "none" {
+		log.Printf("Not sending alert %s, its severity's policy drops it", delivery.Alert)
+		return delivery, 0, 0, errDropped
+	}
+	if !serv.withinTeamRateLimit(delivery.Team) {
+		return delivery, 0, 0, errRateLimited
+	}
+	delivery = serv.correlate(delivery)
+	serv.announceBroadcast(delivery)
+	serv.notifyOthers(ctx, delivery)
+
+	sent, suppressed, deduplicated, errs := serv.notify(ctx, delivery)
+	// Recipients suppressed on purpose are not worth escalating, nor Alertmanager retrying
+	if allSuppressed(sent, suppressed, errs) {
+		return delivery, 0, deduplicated, serv.suppressAlert(delivery)
+	}
+	if sent == 0 && serv.escalationTeam != "" && serv.escalationTeam != delivery.Team {
+		var escalationDuplicates int
+		sent, escalationDuplicates, errs = serv.escalate(ctx, delivery)
+		deduplicated += escalationDuplicates
+	}
+	if len(errs) > 0 {
+		return delivery, sent, deduplicated, errs[0]
+	}
+	return delivery, sent, deduplicated, nil
+}
+
+// Turn a phone number as written in the Sheet or a label into a twilio recipient
+func (serv *Server) formatNumber(number string) (string, error) {
+	if serv.phoneRegion != "" {
+		return normalizePhone(number, serv.phoneRegion)
+	}
+	return formatPhone(number)
+}
+
+// Turn raw phone numbers into twilio recipients, skipping the ones that cannot be used
+func (serv *Server) formatRecipients(team string, recipients []interface{}) []string {
+	formatted := []string{}
+	for _, recipient := range recipients {
+		number := strings.TrimSpace(fmt.Sprint(recipient))
+		// Empty cells between numbers are not recipients
+		if number == "" {
+			continue
+		}
+
+		to, err := serv.formatNumber(number)
+		if err != nil {
+			logMessage(fmt.Sprintf("Skipping recipient for team %s: %s", team, err.Error()))
+			continue
+		}
+		formatted = appendUnique(formatted, to)
+	}
+	return formatted
+}
+
+// Send the delivery's message to every recipient, returns the number of SMS sent, the number of recipients
+// suppressed on purpose, the number of them that were already sent the message and the errors met on the way
+func (serv *Server) notify(ctx context.Context, delivery Delivery) (int, int, int, []error) {
+	var mu sync.Mutex
+	sent := 0
+	suppressed := 0
+	deduplicated := 0
+	var errs []error
+	serv.fanOut(delivery.Recipients, func(number string) {
+		// The recipient got the very same message a moment ago, which is not sending it
+		if serv.duplicate(delivery, number) {
+			mu.Lock()
+			suppressed++
+			deduplicated++
+			mu.Unlock()
+			return
+		}
+		recipient, ok := serv.usableRecipient(ctx, delivery, number)
+		if !ok {
+			serv.forgetSent(delivery, number)
+			mu.Lock()
+			suppressed++
+			mu.Unlock()
+			return
+		}
+		sid, err := serv.deliver(ctx, delivery, recipient)
+		serv.audit.record(delivery, recipient, sid, err)
+		serv.health.sendDone(err)
+		serv.rememberMessages(sid, delivery, recipient)
+		reached := err == nil
+		if err != nil {
+			logError(fmt.Sprintf("Cannot send message to %s: %s", maskPhone(recipient), err.Error()), err, delivery)
+			reached = twilioMessaging(delivery.Channel) && serv.emailFallback(ctx, delivery, recipient)
+		}
+		// A recipient answering the call was reached even without the SMS
+		if delivery.Call && serv.callToo(ctx, delivery, recipient) {
+			reached = true
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !reached {
+			serv.forgetSent(delivery, number)
+			errs = append(errs, err)
+			return
+		}
+		sent++
+	})
+
+	// Copies are for the record, failing to send them must not have the alert sent again
+	serv.fanOut(delivery.CC, func(number string) {
+		if serv.duplicate(delivery, number) {
+			return
+		}
+		recipient, ok := serv.usableRecipient(ctx, delivery, number)
+		if !ok {
+			serv.forgetSent(delivery, number)
+			return
+		}
+		sid, err := serv.deliver(ctx, delivery, recipient)
+		serv.audit.record(delivery, recipient, sid, err)
+		serv.health.sendDone(err)
+		if err != nil {
+			serv.forgetSent(delivery, number)
+			logError(fmt.Sprintf("Cannot send copy to %s: %s", maskPhone(recipient), err.Error()), err, delivery)
+		}
+	})
+	return sent, suppressed, deduplicated, errs
+}
+
+// Call send for every recipient, at most serv.concurrency of them at a time
+func (serv *Server) fanOut(recipients []string, send func(recipient string)) {
+	slots := make(chan struct{}, serv.concurrency)
+	var wg sync.WaitGroup
+	for _, recipient := range recipients {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(recipient string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			send(recipient)
+		}(recipient)
+	}
+	wg.Wait()
+}
+
+// Check whether the delivery's message can be sent to recipient, returns the number to send it to
+func (serv *Server) usableRecipient(ctx context.Context, delivery Delivery, recipient string) (string, bool) {
+	// Lookups are charged for, dry runs must not cost anything
+	if twilioMessaging(delivery.Channel) && !serv.dryRun {
+		var ok bool
+		recipient, ok = serv.verifyRecipient(ctx, recipient)
+		if !ok {
+			return recipient, false
+		}
+	}
+	return recipient, serv.withinRecipientRateLimit(recipient) && serv.withinDailyCap(recipient)
+}
+
+// Send the delivery's message to recipient through the delivery's channel, in several parts when too long
+func (serv *Server) deliver(ctx context.Context, delivery Delivery, recipient string) (string, error) {
+	message := serv.withDeployment(delivery.Message)
+	if serv.dryRun {
+		log.Printf("DRY RUN - not sending %s to %s: %s", delivery.Channel, recipient, message)
+		return "", nil
+	}
+	if delivery.Channel == "call" {
+		return serv.call(ctx, recipient, message)
+	}
+
+	notifier := serv.channelNotifier(delivery.Channel)
+	var sids []string
+	// Each part carries the prefix and suffix, for people to tell where every SMS comes from
+	for _, part := range splitMessage(delivery.Message, delivery.MaxLength, messageLength(serv.withDeployment(""))) {
+		sid, err := notifier.Send(ctx, recipient, serv.withDeployment(part))
+		if err != nil {
+			return strings.Join(sids, ","), err
+		}
+		if sid != "" {
+			sids = append(sids, sid)
+		}
+	}
+	return strings.Join(sids, ","), nil
+}
+
+// Send message through twilio, as a SMS or a WhatsApp message depending on channel
+func (serv *Server) send(ctx context.Context, channel string, recipient string, message string) (string, error) {
+	action := "Sending SMS to"
+	if channel == "whatsapp" {
+		action = "Sending WhatsApp message to"
+	}
+	defer finishSpan(startSpan(ctx, "twilio."+channel, maskPhone(recipient)))
+	sid, err := serv.withRetries(ctx, channel, action, recipient, func(client *http.Client) (string, error) {
+		return serv.sendFromAny(ctx, client, channel, recipient, message)
+	})
+	if err != nil {
+		smsFailed.WithLabelValues(failureReason(err)).Inc()
+		return sid, err
+	}
+	smsSent.Inc()
+	return sid, nil
+}
+
+// Send message from the current sender, failing over to the next ones when twilio rejects the sender
+func (serv *Server) sendFromAny(ctx context.Context, client *http.Client, channel string, recipient string, message string) (string, error) {
+	// Messaging Services and WhatsApp senders pick their own numbers
+	if len(serv.fromNumbers) <= 1 || serv.twilio.MessagingServiceSid != "" || (channel == "whatsapp" && serv.twilio.WhatsappFromNumber != "") {
+		return sendSms(ctx, client, serv.twilio, channel, recipient, message)
+	}
+
+	var err error
+	for tried := 0; tried < len(serv.fromNumbers); tried++ {
+		current := atomic.LoadInt32(&serv.fromIndex)
+		twilio := serv.twilio
+		twilio.FromNumber = serv.fromNumbers[current]
+		var sid string
+		sid, err = sendSms(ctx, client, twilio, channel, recipient, message)
+		if err == nil || !senderError(err) {
+			return sid, err
+		}
+
+		// Later messages start from the next sender too
+		next := (current + 1) % int32(len(serv.fromNumbers))
+		atomic.CompareAndSwapInt32(&serv.fromIndex, current, next)
+		logMessage(fmt.Sprintf("Sender %s rejected by twilio (%s), failing over to %s", twilio.FromNumber, err.Error(), serv.fromNumbers[next]))
+	}
+	return "", err
+}
+
+// Make a twilio request through channel, waiting for a free connection when they are capped
+// and retrying while twilio is saturated or cannot be reached
+func (serv *Server) withRetries(ctx context.Context, channel string, action string, recipient string, request func(client *http.Client) (string, error)) (string, error) {
+	settings := serv.channelSettings(channel)
+	return retrying(ctx, settings, action, maskPhone(recipient), func() (string, error) {
+		sid, err := serv.requestOnce(ctx, func() (string, error) { return request(settings.Client) })
+		if twilioErr, ok := err.(*TwilioError); ok {
+			log.Printf("Twilio %s error %d: %s", twilioErr.Kind(), twilioErr.Code, twilioErr.Message)
+		}
+		return sid, err
+	})
+}
+
+func (serv *Server) requestOnce(ctx context.Context, request func() (string, error)) (string, error) {
+	if serv.twilioSlots != nil {
+		select {
+		case serv.twilioSlots <- struct{}{}:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		defer func() { <-serv.twilioSlots }()
+	}
+	timer := prometheus.NewTimer(twilioDuration)
+	defer timer.ObserveDuration()
+	return request()
+}
+
+// Send the delivery's message to recipient by email when twilio failed, returns whether it was sent
+func (serv *Server) emailFallback(ctx context.Context, delivery Delivery, recipient string) bool {
+	if serv.email.Address == "" {
+		return false
+	}
+
+	log.Printf("Falling back to email-to-SMS gateway for %s", maskPhone(recipient))
+	_, err := serv.channelNotifier("email").Send(ctx, recipient, serv.withDeployment(delivery.Message))
+	delivery.Channel = "email"
+	serv.audit.record(delivery, recipient, "", err)
+	if err != nil {
+		logMessage(err.Error())
+		return false
+	}
+	return true
+}
+
+// Send the delivery's message to the escalation team when nobody from its team could be reached,
+// returns the number of SMS sent, of escalation team members already sent the message and the errors met
+func (serv *Server) escalate(ctx context.Context, delivery Delivery) (int, int, []error) {
+	team := delivery.Team
+	logMessage(fmt.Sprintf("No SMS could be sent to team %s, escalating to team %s", team, serv.escalationTeam))
+	escalations.Inc()
+	escalation, err := serv.getTeamNumbers(ctx, serv.spreadsheet(delivery.Env), serv.escalationTeam)
+	if err != nil {
+		logMessage(err.Error())
+		return 0, 0, []error{err}
+	}
+
+	delivery.Team = serv.escalationTeam
+	delivery.Recipients = serv.formatRecipients(serv.escalationTeam, escalation.Numbers)
+	// Copies were already sent along with the first attempt
+	delivery.CC = nil
+	sent, suppressed, deduplicated, errs := serv.notify(ctx, delivery)
+	if allSuppressed(sent, suppressed, errs) {
+		return 0, deduplicated, []error{serv.suppressAlert(delivery)}
+	}
+	if sent == 0 {
+		logMessage(fmt.Sprintf("Escalation to team %s failed too", serv.escalationTeam))
+		if len(errs) == 0 {
+			errs = append(errs, errors.New(fmt.Sprintf("No SMS could be sent to team %s nor escalation team %s", team, serv.escalationTeam)))
+		}
+	}
+	return sent, deduplicated, errs
+}
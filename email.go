@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Credentials and settings of the SMTP server relaying messages to an email-to-SMS gateway
+type EmailGateway struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	// Recipient address format, "{number}" being replaced by the phone number without its leading +
+	Address string
+}
+
+// An email the SMTP server could not be made to relay
+type EmailError struct {
+	To  string
+	Err error
+}
+
+func (e *EmailError) Error() string {
+	return fmt.Sprintf("Cannot send SMS by email to %s: %s", e.To, e.Err.Error())
+}
+
+// Tell whether sending the email again may succeed, the server being unreachable or answering with a 4xx code
+func (e *EmailError) Temporary() bool {
+	if smtpErr, ok := e.Err.(*textproto.Error); ok {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+	_, ok := e.Err.(net.Error)
+	return ok
+}
+
+// Send message to recipient through the email-to-SMS gateway, giving up after timeout
+func sendEmailSms(gateway EmailGateway, timeout time.Duration, recipient string, message string) error {
+	to := strings.Replace(gateway.Address, "{number}", strings.TrimPrefix(recipient, "+"), -1)
+	log.Printf("Sending SMS by email to %s: %s", to, message)
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Alert\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n", gateway.From, to, message)
+	err := sendMail(gateway, timeout, to, []byte(body))
+	if err != nil {
+		return &EmailError{To: to, Err: err}
+	}
+	log.Printf("Successfully sent SMS by email to %s", to)
+	return nil
+}
+
+// Send an email through the gateway's SMTP server like smtp.SendMail, the whole exchange taking at most timeout
+func sendMail(gateway EmailGateway, timeout time.Duration, to string, body []byte) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(gateway.Host, gateway.Port), timeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	client, err := smtp.NewClient(conn, gateway.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: gateway.Host}); err != nil {
+			return err
+		}
+	}
+	if gateway.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", gateway.Username, gateway.Password, gateway.Host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(gateway.From); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(body); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -6,8 +6,12 @@ require (
 	github.com/getsentry/sentry-go v0.9.0
 	github.com/go-playground/validator/v10 v10.4.1
 	github.com/gorilla/mux v1.8.0
+	github.com/nyaruka/phonenumbers v1.0.55
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/prometheus/alertmanager v0.21.0
-	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
+	github.com/prometheus/client_golang v1.6.0
+	golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
+	golang.org/x/oauth2 v0.0.0-20201208152858-08078c50e5b5
+	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
 	google.golang.org/api v0.38.0
 )
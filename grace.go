@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+)
+
+// Reasons for alerts skipped by the grace window
+var (
+	errHeld             = errors.New("Alert held back by the grace window")
+	errResolvedInWindow = errors.New("Alert resolved within the grace window")
+)
+
+// A firing alert held by the grace window, sent when its timer fires
+type heldAlert struct {
+	timer    *time.Timer
+	alert    template.Alert
+	receiver string
+}
+
+// Get why holdFlapping skipped an alert
+func heldReason(alert template.Alert) error {
+	if alert.Status == "resolved" {
+		return errResolvedInWindow
+	}
+	return errHeld
+}
+
+// Identify an alert across notifications, older Alertmanager versions do not send fingerprints
+func alertKey(alert template.Alert) string {
+	if alert.Fingerprint != "" {
+		return alert.Fingerprint
+	}
+	var pairs []string
+	for _, pair := range alert.Labels.SortedPairs() {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", pair.Name, pair.Value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Hold firing alerts during the grace window and drop them along with their resolve notice
+// when they resolve before it ends, returns true when the alert must not be processed now
+func (serv *Server) holdFlapping(alert template.Alert, receiver string) bool {
+	if serv.graceWindow <= 0 {
+		return false
+	}
+
+	key := alertKey(alert)
+	serv.heldAlertsMu.Lock()
+	defer serv.heldAlertsMu.Unlock()
+
+	entry, held := serv.heldAlerts[key]
+	if alert.Status == "resolved" {
+		if held && entry.timer.Stop() {
+			delete(serv.heldAlerts, key)
+			log.Printf("Alert %s resolved within grace window, dropping it", alert.Labels["alertname"])
+			return true
+		}
+		return false
+	}
+
+	if held {
+		return true
+	}
+
+	delay := serv.graceWindow - time.Since(alert.StartsAt)
+	if delay <= 0 {
+		return false
+	}
+	// Alerts coming in while shutting down are sent right away, nothing would be left to send them later
+	select {
+	case <-serv.stopping:
+		return false
+	default:
+	}
+
+	log.Printf("Holding alert %s for %s", alert.Labels["alertname"], delay.Round(time.Second))
+	serv.heldAlerts[key] = heldAlert{
+		timer: time.AfterFunc(delay, func() {
+			serv.heldAlertsMu.Lock()
+			delete(serv.heldAlerts, key)
+			serv.heldAlertsMu.Unlock()
+			serv.sendHeldAlert(alert, receiver)
+		}),
+		alert:    alert,
+		receiver: receiver,
+	}
+	return true
+}
+
+// Send an alert that was held by the grace window, its failures being only logged
+func (serv *Server) sendHeldAlert(alert template.Alert, receiver string) {
+	_, _, _, err := serv.processAlert(serv.ctx, alert, receiver)
+	if err != nil && err != errDropped && err != errRateLimited && err != errSuppressed {
+		logMessage(fmt.Sprintf("Cannot send held alert %s: %s", alert.Labels["alertname"], err.Error()))
+	}
+}
+
+// Send the alerts held by the grace window right away rather than losing them on shutdown,
+// returns a channel closed once they were all processed
+func (serv *Server) releaseHeldAlerts() <-chan struct{} {
+	serv.heldAlertsMu.Lock()
+	var released []heldAlert
+	for key, entry := range serv.heldAlerts {
+		// An alert the timer of which already fired is being sent
+		if entry.timer.Stop() {
+			released = append(released, entry)
+		}
+		delete(serv.heldAlerts, key)
+	}
+	serv.heldAlertsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, entry := range released {
+			log.Printf("Shutting down, sending alert %s held by the grace window now", entry.alert.Labels["alertname"])
+			serv.sendHeldAlert(entry.alert, entry.receiver)
+		}
+	}()
+	return done
+}
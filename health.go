@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long the outcome of a Sheets connectivity check is reused, probes may come often
+const sheetsCheckTTL = 5 * time.Second
+
+// Keeps track of what tells whether alerts can actually reach people
+type Health struct {
+	maxSheetAge    time.Duration
+	maxFailureRate float64
+	failureWindow  time.Duration
+
+	mu        sync.Mutex
+	lastRead  time.Time
+	sendTimes []time.Time
+	sendFails []bool
+
+	checkMu       sync.Mutex
+	sheetsChecked time.Time
+	sheetsErr     error
+}
+
+// One of the signals readiness is made of
+type HealthFactor struct {
+	Value     string `json:"value"`
+	Threshold string `json:"threshold,omitempty"`
+	Healthy   bool   `json:"healthy"`
+}
+
+type Readiness struct {
+	Ready   bool                    `json:"ready"`
+	Factors map[string]HealthFactor `json:"factors"`
+}
+
+func newHealth(maxSheetAge time.Duration, maxFailureRate float64, failureWindow time.Duration) *Health {
+	return &Health{maxSheetAge: maxSheetAge, maxFailureRate: maxFailureRate, failureWindow: failureWindow}
+}
+
+func (health *Health) sheetRead() {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.lastRead = time.Now()
+}
+
+func (health *Health) sendDone(err error) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.prune()
+	health.sendTimes = append(health.sendTimes, time.Now())
+	health.sendFails = append(health.sendFails, err != nil)
+}
+
+// Forget the sends older than the failure window, the caller holds the lock
+func (health *Health) prune() {
+	start := time.Now().Add(-health.failureWindow)
+	kept := 0
+	for kept < len(health.sendTimes) && health.sendTimes[kept].Before(start) {
+		kept++
+	}
+	health.sendTimes = health.sendTimes[kept:]
+	health.sendFails = health.sendFails[kept:]
+}
+
+// Tell whether the service can page people, along with each signal it is based on
+func (health *Health) readiness() Readiness {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	readiness := Readiness{Ready: true, Factors: make(map[string]HealthFactor)}
+
+	// Numbers are read lazily, a service without alerts has old Sheet data for good reasons
+	sheetAge := HealthFactor{Value: "never read", Healthy: true}
+	if !health.lastRead.IsZero() {
+		age := time.Since(health.lastRead).Round(time.Second)
+		sheetAge.Value = age.String()
+		sheetAge.Healthy = health.maxSheetAge == 0 || age <= health.maxSheetAge
+	}
+	if health.maxSheetAge > 0 {
+		sheetAge.Threshold = health.maxSheetAge.String()
+	}
+	readiness.Factors["sheet_age"] = sheetAge
+
+	health.prune()
+	failures := 0
+	for _, failed := range health.sendFails {
+		if failed {
+			failures++
+		}
+	}
+	failureRate := HealthFactor{Value: "no sends", Healthy: true}
+	if len(health.sendFails) > 0 {
+		rate := float64(failures) / float64(len(health.sendFails))
+		failureRate.Value = strconv.FormatFloat(rate, 'f', 2, 64)
+		failureRate.Healthy = health.maxFailureRate == 0 || rate <= health.maxFailureRate
+	}
+	if health.maxFailureRate > 0 {
+		failureRate.Threshold = strconv.FormatFloat(health.maxFailureRate, 'f', 2, 64)
+	}
+	readiness.Factors["failure_rate"] = failureRate
+
+	for _, factor := range readiness.Factors {
+		readiness.Ready = readiness.Ready && factor.Healthy
+	}
+	return readiness
+}
+
+// Tell orchestrators whether the service can page people
+func (serv *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	readiness := serv.health.readiness()
+	if !readiness.Ready {
+		asJson(w, http.StatusServiceUnavailable, readiness)
+		return
+	}
+	asJson(w, http.StatusOK, readiness)
+}
+
+// Tell whether Google Sheets can be reached with our credentials, reusing recent outcomes
+func (serv *Server) checkSheets(ctx context.Context) error {
+	health := serv.health
+	health.checkMu.Lock()
+	defer health.checkMu.Unlock()
+	if time.Since(health.sheetsChecked) < sheetsCheckTTL {
+		return health.sheetsErr
+	}
+
+	sheets, err := serv.sheetsService()
+	for _, spreadsheet := range serv.spreadsheets {
+		if err != nil {
+			break
+		}
+		// Only ask for the ID, the cheapest metadata there is
+		_, err = sheets.Spreadsheets.Get(spreadsheet.Id).Fields("spreadsheetId").Context(ctx).Do()
+	}
+	// The caller gave up, which says nothing of whether Google Sheets can be reached
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Cannot reach Google Sheets - %s", err.Error()))
+		log.Println(err.Error())
+	}
+	health.sheetsChecked = time.Now()
+	health.sheetsErr = err
+	return err
+}
+
+// Tell orchestrators whether Google Sheets can be reached
+func (serv *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	err := serv.checkSheets(r.Context())
+	if err != nil {
+		asJson(w, http.StatusServiceUnavailable, struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+	asJson(w, http.StatusOK, "ok")
+}
+
+// Tell orchestrators that the service is running
+func livez(w http.ResponseWriter, r *http.Request) {
+	asJson(w, http.StatusOK, "ok")
+}
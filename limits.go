@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Returned for alerts not sent because their team went over its rate limit
+var errRateLimited = errors.New("Alert dropped by its team's rate limit")
+
+// Returned for alerts whose every recipient was suppressed by the daily cap, the rate limit or twilio Lookup
+var errSuppressed = errors.New("Alert suppressed for all of its recipients")
+
+// Tell whether nobody was sent a message only because every recipient was suppressed on purpose
+func allSuppressed(sent int, suppressed int, errs []error) bool {
+	return sent == 0 && suppressed > 0 && len(errs) == 0
+}
+
+// Tokens left to send messages with, refilled at RATE_LIMIT_PER_MINUTE
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Count a message for recipient today and tell whether it stays within the daily cap
+func (serv *Server) withinDailyCap(recipient string) bool {
+	if serv.dailyCap <= 0 {
+		return true
+	}
+
+	key := fmt.Sprintf("%s|%s", recipient, time.Now().Format("2006-01-02"))
+	if serv.dailyCounts.Add(key, 1, 25*time.Hour) == nil {
+		return true
+	}
+	count, err := serv.dailyCounts.IncrementInt(key, 1)
+	if err != nil {
+		return true
+	}
+	if count > serv.dailyCap {
+		smsSuppressed.WithLabelValues("daily_cap").Inc()
+		logMessage(fmt.Sprintf("Daily cap of %d messages reached for %s, suppressing message", serv.dailyCap, maskPhone(recipient)))
+		return false
+	}
+	return true
+}
+
+// Take a token from key's bucket and tell whether one was left, buckets hold a minute of messages
+func (serv *Server) takeToken(key string) bool {
+	serv.rateBucketsMu.Lock()
+	defer serv.rateBucketsMu.Unlock()
+
+	now := time.Now()
+	capacity := float64(serv.rateLimit)
+	bucket := &tokenBucket{tokens: capacity, last: now}
+	if cached, found := serv.rateBuckets.Get(key); found {
+		bucket = cached.(*tokenBucket)
+	}
+	bucket.tokens += now.Sub(bucket.last).Minutes() * capacity
+	if bucket.tokens > capacity {
+		bucket.tokens = capacity
+	}
+	bucket.last = now
+	// Buckets left alone for a minute are full again, they can be forgotten
+	serv.rateBuckets.SetDefault(key, bucket)
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Tell whether an alert of team can be sent, when teams are rate limited
+func (serv *Server) withinTeamRateLimit(team string) bool {
+	if serv.rateLimit <= 0 || serv.rateLimitKey != "team" {
+		return true
+	}
+	if serv.takeToken(team) {
+		return true
+	}
+	smsSuppressed.WithLabelValues("rate_limit").Inc()
+	logMessage(fmt.Sprintf("Rate limit of %d alerts per minute reached for team %s, dropping alert", serv.rateLimit, team))
+	return false
+}
+
+// Tell whether a message for recipient can be sent, when recipients are rate limited
+func (serv *Server) withinRecipientRateLimit(recipient string) bool {
+	if serv.rateLimit <= 0 || serv.rateLimitKey != "recipient" {
+		return true
+	}
+	if serv.takeToken(recipient) {
+		return true
+	}
+	smsSuppressed.WithLabelValues("rate_limit").Inc()
+	logMessage(fmt.Sprintf("Rate limit of %d messages per minute reached for %s, suppressing message", serv.rateLimit, maskPhone(recipient)))
+	return false
+}
+
+// Count an alert none of the recipients of which were sent a message on purpose, returns errSuppressed
+func (serv *Server) suppressAlert(delivery Delivery) error {
+	log.Printf("Not sending alert %s, all recipients of team %s are suppressed", delivery.Alert, delivery.Team)
+	alertsSuppressed.Inc()
+	return errSuppressed
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How long lookup results are kept, phone numbers rarely change line type
+const lookupTTL = 24 * time.Hour
+
+// What twilio Lookup tells about a phone number
+type LookupResult struct {
+	Valid       bool
+	PhoneNumber string
+	LineType    string
+}
+
+// Look a phone number up through twilio Lookup API, asking for its carrier when withCarrier is set
+func lookupNumber(ctx context.Context, client *http.Client, twilio TwilioCredentials, number string, withCarrier bool) (LookupResult, error) {
+	urlStr := fmt.Sprintf("%s/v1/PhoneNumbers/%s", twilio.LookupBaseUrl, url.PathEscape(number))
+	if withCarrier {
+		urlStr += "?Type=carrier"
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	req.SetBasicAuth(twilio.AuthSid, twilio.AuthToken)
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return LookupResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return LookupResult{Valid: false}, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return LookupResult{}, newTwilioError(resp, body)
+	}
+
+	var data struct {
+		PhoneNumber string `json:"phone_number"`
+		Carrier     struct {
+			Type string `json:"type"`
+		} `json:"carrier"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return LookupResult{}, err
+	}
+	return LookupResult{Valid: true, PhoneNumber: data.PhoneNumber, LineType: data.Carrier.Type}, nil
+}
+
+// Check recipient through twilio Lookup when enabled, returns its normalized number and whether it can be sent SMS
+func (serv *Server) verifyRecipient(ctx context.Context, recipient string) (string, bool) {
+	if !serv.lookupEnabled {
+		return recipient, true
+	}
+
+	var result LookupResult
+	if entry, found := serv.lookupCache.Get(recipient); found {
+		result = entry.(LookupResult)
+	} else {
+		// Lookups count against the cap on concurrent twilio requests like sends
+		_, err := serv.requestOnce(ctx, func() (string, error) {
+			var err error
+			result, err = lookupNumber(ctx, serv.twilioClient, serv.twilio, recipient, len(serv.lookupLineTypes) > 0)
+			return "", err
+		})
+		if err != nil {
+			// Lookup is a safety net, failing to use it must not prevent paging
+			logMessage(fmt.Sprintf("Cannot look %s up, sending anyway: %s", maskPhone(recipient), err.Error()))
+			return recipient, true
+		}
+		serv.lookupCache.Set(recipient, result, lookupTTL)
+	}
+
+	if !result.Valid {
+		logMessage(fmt.Sprintf("Skipping %s, twilio Lookup does not know this number", maskPhone(recipient)))
+		smsSuppressed.WithLabelValues("lookup").Inc()
+		return recipient, false
+	}
+	if len(serv.lookupLineTypes) > 0 && !contains(serv.lookupLineTypes, result.LineType) {
+		logMessage(fmt.Sprintf("Skipping %s, its line type \"%s\" cannot be sent SMS", maskPhone(recipient), result.LineType))
+		smsSuppressed.WithLabelValues("lookup").Inc()
+		return recipient, false
+	}
+	if result.PhoneNumber != "" && result.PhoneNumber != recipient {
+		log.Printf("Twilio Lookup normalized %s into %s", maskPhone(recipient), maskPhone(result.PhoneNumber))
+		return result.PhoneNumber, true
+	}
+	return recipient, true
+}
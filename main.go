@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -18,38 +25,299 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/patrickmn/go-cache"
 	"github.com/prometheus/alertmanager/template"
-	"golang.org/x/net/context"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	"google.golang.org/api/sheets/v4"
 )
 
-const readRange = "A2:D"
-
 var regexpPhone = regexp.MustCompile("^\\+[1-9]\\d{1,14}$")
 var regexpTwilioSid = regexp.MustCompile("^[A-Z]{2}[0-9a-f]{32}$")
+var regexpMessagingServiceSid = regexp.MustCompile("^MG[0-9a-f]{32}$")
 var regexpSheetId = regexp.MustCompile("^[a-zA-Z0-9-_]+$")
+var regexpBasePath = regexp.MustCompile("^(/[a-zA-Z0-9-_.~]+)+$")
+var regexpColumn = regexp.MustCompile("^[A-Z]{1,2}$")
+var regexpCountryCodes = regexp.MustCompile("^[1-9][0-9]{0,2}(,[1-9][0-9]{0,2})*$")
+var regexpSheetRange = regexp.MustCompile("^([A-Z]{1,2})([1-9][0-9]*):([A-Z]{1,2})([1-9][0-9]*)?$")
+var regexpA1Range = regexp.MustCompile("^('[^']+'!|[a-zA-Z0-9_]+!)?[A-Z]{1,2}[0-9]*(:[A-Z]{1,2}[0-9]*)?$")
+var regexpLabelName = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
 var regexpPort = regexp.MustCompile("^([0-9]{1,4}|[1-5][0-9]{4}|6[0-4][0-9]{3}|65[0-4][0-9]{2}|655[0-2][0-9]|6553[0-5])$")
-var useSentry = false
+
+var errEmptySheet = errors.New("Sheet appears to be empty :(")
+
+// How long teams read from the Sheet are used before reading it again
+const shortCacheTTL = 10 * time.Minute
+
+// How long a team without a row in the Sheet is remembered as such, not to read the whole Sheet again for each of its alerts
+const unknownTeamTTL = time.Minute
+
+// How long to wait at first between Sheet read attempts
+const defaultSheetRetryDelay = time.Second
 
 type Config struct {
-	TwilioAccountSid string `validate:"required,twiliosid"`
-	TwilioAuthSid    string `validate:"required,twiliosid"`
-	TwilioAuthToken  string `validate:"required,min=1"`
-	TwilioFromNumber string `validate:"required,phone"`
-	GoogleSheetId    string `validate:"required,sheetid"`
-	GoogleTokenPath  string `validate:"required,file"`
-	ListenPort       string `validate:"omitempty,port"`
-	SentryDsn        string `validate:"omitempty,min=1"`
+	TwilioAccountSid     string `env:"TWILIO_ACCOUNT_SID" validate:"required,twiliosid"`
+	TwilioAuthSid        string `env:"TWILIO_AUTH_SID" validate:"required,twiliosid"`
+	TwilioAuthToken      string `env:"TWILIO_AUTH_TOKEN" validate:"required,min=1"`
+	TwilioFromNumber     string `env:"TWILIO_FROM_NUMBER" validate:"required_without=TwilioMessagingSid,omitempty,phones"`
+	TwilioMessagingSid   string `env:"TWILIO_MESSAGING_SERVICE_SID" validate:"omitempty,messagingsid"`
+	TwilioWhatsappFrom   string `env:"TWILIO_WHATSAPP_FROM_NUMBER" validate:"omitempty,phone"`
+	TwilioStatusCallback string `env:"TWILIO_STATUS_CALLBACK_URL" validate:"omitempty,url"`
+	TwilioApiBaseUrl     string `env:"TWILIO_API_BASE_URL" validate:"omitempty,url"`
+	TwilioLookupBaseUrl  string `env:"TWILIO_LOOKUP_BASE_URL" validate:"omitempty,url"`
+	TwilioAccountToken   string `env:"TWILIO_ACCOUNT_AUTH_TOKEN"`
+	DeliveryChannel      string `env:"DELIVERY_CHANNEL" validate:"omitempty,oneof=sms whatsapp"`
+	DryRun               string `env:"DRY_RUN" validate:"omitempty,boolean"`
+	CheckSenders         string `env:"TWILIO_CHECK_SENDERS" validate:"omitempty,boolean"`
+	StrictStartup        string `env:"STRICT_STARTUP" validate:"omitempty,boolean"`
+	GoogleSheetId        string `env:"GOOGLE_SHEET_ID" validate:"required,sheetids"`
+	GoogleTokenPath      string `env:"GOOGLE_TOKEN_PATH" validate:"required_without=GoogleTokenJson,excluded_with=GoogleTokenJson,omitempty,file"`
+	GoogleTokenJson      string `env:"GOOGLE_CREDENTIALS_JSON" validate:"omitempty,json"`
+	GoogleSubject        string `env:"GOOGLE_IMPERSONATE_SUBJECT" validate:"omitempty,email"`
+	GoogleSheetRange     string `env:"GOOGLE_SHEET_RANGE" validate:"omitempty,sheetrange"`
+	GoogleSheetName      string `env:"GOOGLE_SHEET_NAME" validate:"omitempty"`
+	SheetRefreshInterval string `env:"SHEET_REFRESH_INTERVAL" validate:"omitempty,duration"`
+	SheetRetries         string `env:"SHEET_READ_RETRIES" validate:"omitempty,uint"`
+	SheetHeaderRow       string `env:"SHEET_HEADER_ROW" validate:"required_with=SheetTeamColumn ScheduleTimezone,omitempty,uint,ne=0"`
+	ScheduleTimezone     string `env:"SCHEDULE_TIMEZONE" validate:"omitempty,timezone"`
+	SheetTeamColumn      string `env:"SHEET_TEAM_COLUMN" validate:"required_with=SheetPhoneColumns"`
+	SheetPhoneColumns    string `env:"SHEET_PHONE_COLUMNS" validate:"required_with=SheetTeamColumn"`
+	SheetRetryDelay      string `env:"SHEET_RETRY_DELAY" validate:"omitempty,duration"`
+	SheetCaseSensitive   string `env:"SHEET_MATCH_CASE_SENSITIVE" validate:"omitempty,boolean"`
+	LongCacheFile        string `env:"FALLBACK_CACHE_FILE" validate:"omitempty"`
+	ListenPort           string `env:"PORT" validate:"omitempty,port"`
+	TlsCertFile          string `env:"TLS_CERT_FILE" validate:"required_with=TlsKeyFile,omitempty,file"`
+	TlsKeyFile           string `env:"TLS_KEY_FILE" validate:"required_with=TlsCertFile,omitempty,file"`
+	SmtpHost             string `env:"SMTP_HOST" validate:"required_with=EmailGateway,omitempty,hostname|ip"`
+	SmtpPort             string `env:"SMTP_PORT" validate:"omitempty,port"`
+	SmtpUsername         string `env:"SMTP_USERNAME" validate:"required_with=SmtpPassword"`
+	SmtpPassword         string `env:"SMTP_PASSWORD"`
+	SmtpFrom             string `env:"SMTP_FROM" validate:"required_with=EmailGateway,omitempty,email"`
+	EmailGateway         string `env:"EMAIL_SMS_GATEWAY" validate:"omitempty,contains={number}"`
+	SentryDsn            string `env:"SENTRY_DSN" validate:"omitempty,sentrydsn"`
+	SentryMaxFailures    string `env:"SENTRY_MAX_FAILURES" validate:"omitempty,uint,ne=0"`
+	SentryTracesRate     string `env:"SENTRY_TRACES_SAMPLE_RATE" validate:"omitempty,ratio"`
+	SentryFlushTimeout   string `env:"SENTRY_FLUSH_TIMEOUT" validate:"omitempty,duration"`
+	ShutdownTimeout      string `env:"SHUTDOWN_TIMEOUT" validate:"omitempty,duration"`
+	PhoneRegion          string `env:"PHONE_DEFAULT_REGION" validate:"omitempty,iso3166_1_alpha2"`
+	LabelCountryCodes    string `env:"LABEL_ALLOWED_COUNTRY_CODES" validate:"omitempty,countrycodes"`
+	BasePath             string `env:"BASE_PATH" validate:"omitempty,basepath"`
+	WebhookPath          string `env:"WEBHOOK_PATH" validate:"omitempty,basepath"`
+	WebhookSecret        string `env:"WEBHOOK_SECRET" validate:"omitempty"`
+	BasicAuthUser        string `env:"WEBHOOK_BASIC_AUTH_USER" validate:"required_with=BasicAuthPassword"`
+	BasicAuthPassword    string `env:"WEBHOOK_BASIC_AUTH_PASSWORD" validate:"required_with=BasicAuthUser"`
+	AllowedCidrs         string `env:"WEBHOOK_ALLOWED_CIDRS" validate:"omitempty,cidrs"`
+	MaxBodyBytes         string `env:"MAX_BODY_BYTES" validate:"omitempty,uint,ne=0"`
+	TrustedProxy         string `env:"TRUSTED_PROXY" validate:"omitempty,boolean"`
+	EscalationTeam       string `env:"ESCALATION_TEAM" validate:"omitempty,min=1"`
+	DefaultTeam          string `env:"DEFAULT_TEAM" validate:"omitempty,min=1"`
+	CCNumbers            string `env:"ALWAYS_CC_NUMBERS" validate:"omitempty,phones"`
+	ReceiverInMsg        string `env:"RECEIVER_IN_MESSAGE" validate:"omitempty,boolean"`
+	MessagePrefix        string `env:"MESSAGE_PREFIX" validate:"omitempty"`
+	MessageSuffix        string `env:"MESSAGE_SUFFIX" validate:"omitempty"`
+	ReceiverInLogs       string `env:"RECEIVER_IN_LOGS" validate:"omitempty,boolean"`
+	GraceWindow          string `env:"GRACE_WINDOW" validate:"omitempty,duration"`
+	DedupWindow          string `env:"DEDUP_WINDOW" validate:"omitempty,duration"`
+	CorrelationCodes     string `env:"MESSAGE_CORRELATION_CODE" validate:"omitempty,boolean"`
+	MaxLength            string `env:"SMS_MAX_LENGTH" validate:"omitempty,smslength"`
+	SplitMode            string `env:"SMS_SPLIT_MODE" validate:"omitempty,oneof=truncate split"`
+	StatusPosition       string `env:"MESSAGE_STATUS_POSITION" validate:"omitempty,oneof=prefix suffix"`
+	TwilioMaxConns       string `env:"TWILIO_MAX_CONNECTIONS" validate:"omitempty,uint"`
+	Concurrency          string `env:"TWILIO_CONCURRENCY" validate:"omitempty,uint,ne=0"`
+	TwilioRetries        string `env:"TWILIO_MAX_RETRIES" validate:"omitempty,uint"`
+	TwilioTimeout        string `env:"TWILIO_HTTP_TIMEOUT" validate:"omitempty,duration"`
+	TwilioIdleConns      string `env:"TWILIO_MAX_IDLE_CONNECTIONS" validate:"omitempty,uint,ne=0"`
+	TwilioIdleTimeout    string `env:"TWILIO_IDLE_CONNECTION_TIMEOUT" validate:"omitempty,duration"`
+	TwilioRetryDelay     string `env:"TWILIO_RETRY_BASE_DELAY" validate:"omitempty,duration"`
+	SmsRetries           string `env:"SMS_MAX_RETRIES" validate:"omitempty,uint"`
+	SmsRetryDelay        string `env:"SMS_RETRY_BASE_DELAY" validate:"omitempty,duration"`
+	SmsTimeout           string `env:"SMS_HTTP_TIMEOUT" validate:"omitempty,duration"`
+	WhatsappRetries      string `env:"WHATSAPP_MAX_RETRIES" validate:"omitempty,uint"`
+	WhatsappRetryDelay   string `env:"WHATSAPP_RETRY_BASE_DELAY" validate:"omitempty,duration"`
+	WhatsappTimeout      string `env:"WHATSAPP_HTTP_TIMEOUT" validate:"omitempty,duration"`
+	VoiceRetries         string `env:"VOICE_MAX_RETRIES" validate:"omitempty,uint"`
+	VoiceRetryDelay      string `env:"VOICE_RETRY_BASE_DELAY" validate:"omitempty,duration"`
+	VoiceTimeout         string `env:"VOICE_HTTP_TIMEOUT" validate:"omitempty,duration"`
+	SmtpRetries          string `env:"SMTP_MAX_RETRIES" validate:"omitempty,uint"`
+	SmtpRetryDelay       string `env:"SMTP_RETRY_BASE_DELAY" validate:"omitempty,duration"`
+	SmtpTimeout          string `env:"SMTP_TIMEOUT" validate:"omitempty,duration"`
+	WebhookRetries       string `env:"NOTIFY_WEBHOOK_MAX_RETRIES" validate:"omitempty,uint"`
+	WebhookRetryDelay    string `env:"NOTIFY_WEBHOOK_RETRY_BASE_DELAY" validate:"omitempty,duration"`
+	WebhookTimeout       string `env:"NOTIFY_WEBHOOK_HTTP_TIMEOUT" validate:"omitempty,duration"`
+	DailyCap             string `env:"RECIPIENT_DAILY_CAP" validate:"omitempty,uint"`
+	MaxRecipients        string `env:"MAX_RECIPIENTS_PER_ALERT" validate:"omitempty,uint"`
+	PhoneLabelMode       string `env:"PHONE_LABEL_MODE" validate:"omitempty,oneof=override append"`
+	StrictRecipients     string `env:"MAX_RECIPIENTS_STRICT" validate:"omitempty,boolean"`
+	RateLimit            string `env:"RATE_LIMIT_PER_MINUTE" validate:"omitempty,uint"`
+	RateLimitKey         string `env:"RATE_LIMIT_KEY" validate:"omitempty,oneof=team recipient"`
+	LookupEnabled        string `env:"TWILIO_LOOKUP_ENABLED" validate:"omitempty,boolean"`
+	LookupLineTypes      string `env:"TWILIO_LOOKUP_LINE_TYPES" validate:"omitempty"`
+	ActiveColumn         string `env:"SHEET_ACTIVE_COLUMN" validate:"omitempty,column"`
+	HeaderColumn         string `env:"SHEET_HEADER_COLUMN" validate:"omitempty,column"`
+	FooterColumn         string `env:"SHEET_FOOTER_COLUMN" validate:"omitempty,column"`
+	MaxLengthColumn      string `env:"SHEET_MAX_LENGTH_COLUMN" validate:"omitempty,column"`
+	TemplateColumn       string `env:"SHEET_TEMPLATE_COLUMN" validate:"omitempty,column"`
+	OverrideCell         string `env:"SHEET_OVERRIDE_CELL" validate:"required_with=BroadcastTeam,omitempty,a1range"`
+	BroadcastTeam        string `env:"BROADCAST_TEAM" validate:"required_with=OverrideCell"`
+	DescriptionTmpl      string `env:"MESSAGE_DESCRIPTION_TEMPLATE" validate:"omitempty,gotemplate"`
+	MessageTmpl          string `env:"MESSAGE_TEMPLATE" validate:"omitempty,gotemplate"`
+	SimulateEnabled      string `env:"SIMULATE_ENABLED" validate:"omitempty,boolean,authenticated"`
+	TestEnabled          string `env:"TEST_ENDPOINT_ENABLED" validate:"omitempty,boolean,authenticated"`
+	TestNumbers          string `env:"TEST_ALLOWED_NUMBERS" validate:"omitempty,phones"`
+	TeamsEnabled         string `env:"TEAMS_ENDPOINT_ENABLED" validate:"omitempty,boolean,authenticated"`
+	RefreshEnabled       string `env:"REFRESH_ENDPOINT_ENABLED" validate:"omitempty,boolean,authenticated"`
+	DebugEnabled         string `env:"DEBUG_ENDPOINTS_ENABLED" validate:"omitempty,boolean,authenticated"`
+	WebhookDeadline      string `env:"WEBHOOK_DEADLINE" validate:"omitempty,duration"`
+	TeamAliases          string `env:"TEAM_ALIASES" validate:"omitempty,stringmap"`
+	TeamSeparator        string `env:"TEAM_LABEL_SEPARATOR" validate:"omitempty,max=1"`
+	LookupLabel          string `env:"LOOKUP_LABEL" validate:"omitempty,labelname"`
+	AuditSink            string `env:"AUDIT_SINK" validate:"omitempty,oneof=log file"`
+	ReadyMaxSheetAge     string `env:"READY_MAX_SHEET_AGE" validate:"omitempty,duration"`
+	ReadyMaxFailureRate  string `env:"READY_MAX_FAILURE_RATE" validate:"omitempty,ratio"`
+	ReadyFailureWindow   string `env:"READY_FAILURE_WINDOW" validate:"omitempty,duration"`
+	AuditFile            string `env:"AUDIT_FILE" validate:"required_if=AuditSink file"`
+	Coalesce             string `env:"COALESCE_BY_RECIPIENT" validate:"omitempty,boolean"`
+	CommonLabels         string `env:"COALESCE_COMMON_LABELS" validate:"omitempty"`
+	PerAlertTeams        string `env:"COALESCE_EXCLUDED_TEAMS" validate:"omitempty"`
+	SeverityPolicies     string `env:"SEVERITY_POLICIES" validate:"omitempty,severitypolicies"`
+	VoiceEnabled         string `env:"VOICE_ENABLED" validate:"omitempty,boolean,callable"`
+	VoiceSeverities      string `env:"VOICE_SEVERITIES"`
+	VoiceTwimlUrl        string `env:"VOICE_TWIML_URL" validate:"omitempty,url"`
+	NotifyWebhookUrl     string `env:"NOTIFY_WEBHOOK_URL" validate:"omitempty,url"`
+	NotifyWebhookSevs    string `env:"NOTIFY_WEBHOOK_SEVERITIES" validate:"omitempty"`
+	ResolvedPriority     string `env:"RESOLVED_PRIORITY" validate:"omitempty,oneof=normal low background"`
+	NotifyOnResolved     string `env:"NOTIFY_ON_RESOLVED" validate:"omitempty,boolean"`
 }
 
 type Server struct {
 	mux http.Handler
+	// Canceled once shutdown gave up waiting, stopping the calls to twilio and Google still running
+	ctx  context.Context
+	stop context.CancelFunc
+	// Closed once shutdown starts, stopping the background work that is not serving requests
+	stopping chan struct{}
+
+	twilio       TwilioCredentials
+	twilioClient *http.Client
+	email        EmailGateway
+	twilioSlots  chan struct{}
+	// Senders SMS fail over to, starting from fromIndex
+	fromNumbers []string
+	fromIndex   int32
+	// Auth token twilio signs its requests with, the account's rather than an API key's
+	twilioSigningToken string
+	concurrency        int
+	dailyCap           int
+	// Retry and timeout settings of each channel, webhook standing for the notification webhook
+	channels map[string]ChannelSettings
+	// Recipients an alert is sent to at most, 0 for no limit, failing the alert past it when strict
+	maxRecipients    int
+	strictRecipients bool
+	// Whether phone_numbers labels add to the team's numbers rather than replacing them
+	appendLabelNumbers bool
+	rateLimit          int
+	rateLimitKey       string
+	lookupEnabled      bool
+	lookupLineTypes    []string
+	google             GoogleCredentials
+
+	shortCache    *cache.Cache
+	longCache     *cache.Cache
+	longCachePath string
+	unknownTeams  *cache.Cache
+	dailyCounts   *cache.Cache
+	rateBuckets   *cache.Cache
+	dedupCache    *cache.Cache
+	rateBucketsMu sync.Mutex
+	lookupCache   *cache.Cache
+	receipts      *cache.Cache
+	lookups       *LookupCounts
+	sheetReads    singleflight.Group
+	// Spreadsheets teams are read from, the default one first
+	spreadsheets    []Spreadsheet
+	sheetsClient    *SheetsClient
+	sheetRetries    int
+	headerRow       int
+	sheetRetryDelay time.Duration
+	sheetRange      SheetRange
+	sheetName       string
+	strictTeams     bool
+	// Time zone of the time windows named by the header row, nil when numbers are not scheduled
+	scheduleLocation *time.Location
+	// Names of the header row's columns holding teams and their phone numbers, when not read by position
+	teamColumn   string
+	phoneColumns []string
+
+	activeColumn    int
+	headerColumn    int
+	footerColumn    int
+	maxLengthColumn int
+	templateColumn  int
+
+	overrideCell  string
+	broadcastTeam string
+	overrideCache *cache.Cache
+
+	phoneRegion       string
+	labelCountryCodes map[int]bool
+	basePath          string
+	webhookSecret     string
+	basicAuthUser     string
+	basicAuthPassword string
+	allowedNetworks   []*net.IPNet
+	trustedProxy      bool
+	maxBodyBytes      int64
+	// Signatures of the requests to management endpoints already accepted, for them not to be replayed
+	seenSignatures *cache.Cache
+
+	webhookDeadline  time.Duration
+	coalesce         bool
+	severityPolicies map[string]SeverityPolicy
+	commonLabels     []string
+	// Teams keeping one message per alert when messages are coalesced, by team key
+	perAlertTeams    map[string]bool
+	resolvedPriority string
+	notifyOnResolved bool
+	deliveryChannel  string
+	dryRun           bool
+	voiceEnabled     bool
+	voiceSeverities  []string
+	voiceTwimlUrl    string
+	// Numbers test messages may be sent to, any recipient of a team when empty
+	testNumbers []string
+	// Backends messages are also sent through for the alerts of some severities
+	notifiers          []Notifier
+	notifierSeverities []string
+
+	audit  *Auditor
+	health *Health
+
+	escalationTeam string
+	defaultTeam    string
+	ccNumbers      []string
+	teamAliases    map[string]string
+	teamSeparator  string
+	// Label whose value is looked up in the Sheet's team column
+	lookupLabel string
+
+	receiverInMsg  bool
+	receiverInLogs bool
+	// Put around the messages people receive, telling which deployment paged them
+	messagePrefix    string
+	messageSuffix    string
+	statusPosition   string
+	correlationCodes bool
+	maxLength        int
+	splitMode        string
 
-	twilio TwilioCredentials
-	google GoogleCredentials
+	descriptionTemplate *texttemplate.Template
+	messageTemplate     *texttemplate.Template
 
-	shortCache *cache.Cache
-	longCache  *cache.Cache
+	graceWindow  time.Duration
+	dedupWindow  time.Duration
+	heldAlerts   map[string]heldAlert
+	heldAlertsMu sync.Mutex
 }
 
 type TwilioCredentials struct {
@@ -57,16 +325,30 @@ type TwilioCredentials struct {
 	AuthSid    string
 	AuthToken  string
 	FromNumber string
+	// Messaging Service SMS are sent through instead of FromNumber, when set
+	MessagingServiceSid string
+	// Sender of WhatsApp messages when it is not FromNumber
+	WhatsappFromNumber string
+	// URL twilio sends delivery receipts to, when set
+	StatusCallback string
+	// Where twilio's REST API is reached, e.g. a regional edge or a stub
+	ApiBaseUrl string
+	// Where twilio Lookup is reached, it has a domain of its own
+	LookupBaseUrl string
 }
 
 type GoogleCredentials struct {
 	SpreadsheetId string
 	TokenPath     string
+	// Service account token given inline instead of TokenPath, when set
+	TokenJson string
+	// Workspace user the service account impersonates through domain-wide delegation, when set
+	Subject string
 }
 
 func logMessage(message string) {
 	log.Println(message)
-	if useSentry {
+	if usingSentry() {
 		sentry.CaptureMessage(message)
 	}
 }
@@ -84,20 +366,285 @@ func asJson(w http.ResponseWriter, statusCode int, message interface{}) {
 	w.Write(js)
 }
 
+// Parse an already validated boolean parameter, empty values get the default
+func parseBool(value string, defaultValue bool) bool {
+	if value == "" {
+		return defaultValue
+	}
+	parsed, _ := strconv.ParseBool(value)
+	return parsed
+}
+
+// Parse an already validated non-negative integer parameter, empty values get the default
+func parseUint(value string, defaultValue int) int {
+	if value == "" {
+		return defaultValue
+	}
+	parsed, _ := strconv.Atoi(value)
+	return parsed
+}
+
+// Parse a comma-separated list parameter
+func parseList(value string) []string {
+	var parsed []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			parsed = append(parsed, item)
+		}
+	}
+	return parsed
+}
+
+// Parse an already validated JSON object of strings parameter
+func parseStringMap(value string) map[string]string {
+	parsed := make(map[string]string)
+	if value != "" {
+		_ = json.Unmarshal([]byte(value), &parsed)
+	}
+	return parsed
+}
+
+// Parse an already validated ratio parameter between 0 and 1, empty values get 0
+func parseRatio(value string) float64 {
+	parsed, _ := strconv.ParseFloat(value, 64)
+	return parsed
+}
+
+// Parse an already validated duration parameter, empty values get the default
+func parseDuration(value string, defaultValue time.Duration) time.Duration {
+	if value == "" {
+		return defaultValue
+	}
+	parsed, _ := time.ParseDuration(value)
+	return parsed
+}
+
 func newServer(config Config) *Server {
 	serv := &Server{
-		twilio: TwilioCredentials{config.TwilioAccountSid, config.TwilioAuthSid, config.TwilioAuthToken, config.TwilioFromNumber},
-		google: GoogleCredentials{config.GoogleSheetId, config.GoogleTokenPath},
+		twilio:          TwilioCredentials{config.TwilioAccountSid, config.TwilioAuthSid, config.TwilioAuthToken, "", config.TwilioMessagingSid, config.TwilioWhatsappFrom, config.TwilioStatusCallback, "", ""},
+		google:          GoogleCredentials{config.GoogleSheetId, config.GoogleTokenPath, config.GoogleTokenJson, config.GoogleSubject},
+		sheetRetries:    parseUint(config.SheetRetries, 0),
+		headerRow:       parseUint(config.SheetHeaderRow, 0),
+		sheetRetryDelay: parseDuration(config.SheetRetryDelay, defaultSheetRetryDelay),
+		sheetRange:      parseSheetRange(config.GoogleSheetRange),
+		sheetName:       config.GoogleSheetName,
+		email:           EmailGateway{config.SmtpHost, config.SmtpPort, config.SmtpUsername, config.SmtpPassword, config.SmtpFrom, config.EmailGateway},
+
+		phoneRegion:       config.PhoneRegion,
+		labelCountryCodes: parseCountryCodes(config.LabelCountryCodes),
+		basePath:          config.BasePath,
+		webhookSecret:     config.WebhookSecret,
+		basicAuthUser:     config.BasicAuthUser,
+		basicAuthPassword: config.BasicAuthPassword,
+		allowedNetworks:   parseCidrs(config.AllowedCidrs),
+		trustedProxy:      parseBool(config.TrustedProxy, false),
+		maxBodyBytes:      int64(parseUint(config.MaxBodyBytes, defaultMaxBodyBytes)),
+		seenSignatures:    cache.New(2*signatureMaxAge, 10*time.Minute),
+
+		webhookDeadline:  parseDuration(config.WebhookDeadline, 0),
+		coalesce:         parseBool(config.Coalesce, false),
+		severityPolicies: parseSeverityPolicies(config.SeverityPolicies),
+		commonLabels:     parseList(config.CommonLabels),
+		resolvedPriority: config.ResolvedPriority,
+		notifyOnResolved: parseBool(config.NotifyOnResolved, true),
+		deliveryChannel:  config.DeliveryChannel,
+		dryRun:           parseBool(config.DryRun, false),
+		voiceEnabled:     parseBool(config.VoiceEnabled, false),
+		voiceTwimlUrl:    config.VoiceTwimlUrl,
+
+		audit:  newAuditor(config.AuditSink, config.AuditFile),
+		health: newHealth(parseDuration(config.ReadyMaxSheetAge, 0), parseRatio(config.ReadyMaxFailureRate), parseDuration(config.ReadyFailureWindow, 5*time.Minute)),
+
+		escalationTeam: config.EscalationTeam,
+		defaultTeam:    config.DefaultTeam,
+		ccNumbers:      parseList(config.CCNumbers),
+		teamSeparator:  config.TeamSeparator,
+		lookupLabel:    config.LookupLabel,
+
+		receiverInMsg:    parseBool(config.ReceiverInMsg, false),
+		messagePrefix:    config.MessagePrefix,
+		messageSuffix:    config.MessageSuffix,
+		receiverInLogs:   parseBool(config.ReceiverInLogs, true),
+		statusPosition:   config.StatusPosition,
+		correlationCodes: parseBool(config.CorrelationCodes, false),
+		maxLength:        parseUint(config.MaxLength, maxMessageLength),
+		splitMode:        config.SplitMode,
+
+		graceWindow: parseDuration(config.GraceWindow, 0),
+		dedupWindow: parseDuration(config.DedupWindow, defaultDedupWindow),
+		heldAlerts:  make(map[string]heldAlert),
 	}
 
-	// Init router and routes
+	// Init router and routes, all of them living under the base path
 	router := mux.NewRouter()
-	router.HandleFunc("/webhook", serv.webhook)
+	routes := router
+	if serv.basePath != "" {
+		routes = router.PathPrefix(serv.basePath).Subrouter()
+	}
+	webhookPath := "/webhook"
+	if config.WebhookPath != "" {
+		webhookPath = config.WebhookPath
+	}
+	routes.HandleFunc(webhookPath, countRequests(webhookRequests, traced("POST "+webhookPath, serv.webhook)))
+	routes.Handle("/metrics", promhttp.Handler())
+	routes.HandleFunc("/readyz", serv.readyz)
+	routes.HandleFunc("/healthz", serv.healthz)
+	routes.HandleFunc("/livez", livez)
+	if config.TwilioStatusCallback != "" {
+		routes.HandleFunc("/twilio/status", serv.messageStatus)
+	}
+	if parseBool(config.SimulateEnabled, false) {
+		routes.HandleFunc("/simulate", serv.simulate)
+	}
+	if parseBool(config.TestEnabled, false) {
+		routes.HandleFunc("/test", serv.sendTest)
+	}
+	if parseBool(config.TeamsEnabled, false) {
+		routes.HandleFunc("/teams", serv.teams)
+	}
+	if parseBool(config.RefreshEnabled, false) {
+		routes.HandleFunc("/refresh", serv.refresh)
+	}
+	if parseBool(config.DebugEnabled, false) {
+		routes.HandleFunc("/debug/cache", serv.cacheStats)
+	}
 	serv.mux = router
 
-	serv.shortCache = cache.New(10*time.Minute, 10*time.Minute)
+	descriptionTemplate := defaultDescriptionTemplate
+	if config.DescriptionTmpl != "" {
+		descriptionTemplate = config.DescriptionTmpl
+	}
+	serv.descriptionTemplate = texttemplate.Must(texttemplate.New("description").Parse(descriptionTemplate))
+	if config.MessageTmpl != "" {
+		serv.messageTemplate = texttemplate.Must(texttemplate.New("message").Parse(config.MessageTmpl))
+	}
+
+	serv.fromNumbers = parseList(config.TwilioFromNumber)
+	if len(serv.fromNumbers) > 0 {
+		serv.twilio.FromNumber = serv.fromNumbers[0]
+	}
+	serv.twilio.ApiBaseUrl = defaultTwilioApiBaseUrl
+	if config.TwilioApiBaseUrl != "" {
+		serv.twilio.ApiBaseUrl = strings.TrimSuffix(config.TwilioApiBaseUrl, "/")
+	}
+	serv.twilio.LookupBaseUrl = defaultTwilioLookupBaseUrl
+	if config.TwilioLookupBaseUrl != "" {
+		serv.twilio.LookupBaseUrl = strings.TrimSuffix(config.TwilioLookupBaseUrl, "/")
+	}
+
+	if serv.email.Port == "" {
+		serv.email.Port = "587"
+	}
+
+	if serv.deliveryChannel == "" {
+		serv.deliveryChannel = "sms"
+	}
+
+	voiceSeverities := defaultVoiceSeverities
+	if config.VoiceSeverities != "" {
+		voiceSeverities = config.VoiceSeverities
+	}
+	serv.voiceSeverities = parseList(voiceSeverities)
+
+	notifierSeverities := defaultNotifyWebhookSeverities
+	if config.NotifyWebhookSevs != "" {
+		notifierSeverities = config.NotifyWebhookSevs
+	}
+	serv.notifierSeverities = parseList(notifierSeverities)
+
+	serv.activeColumn = optionalColumn(config.ActiveColumn)
+	serv.headerColumn = optionalColumn(config.HeaderColumn)
+	serv.footerColumn = optionalColumn(config.FooterColumn)
+	serv.maxLengthColumn = optionalColumn(config.MaxLengthColumn)
+	serv.templateColumn = optionalColumn(config.TemplateColumn)
+
+	serv.overrideCell = config.OverrideCell
+	serv.broadcastTeam = config.BroadcastTeam
+	serv.overrideCache = cache.New(overrideTTL, overrideTTL)
+
+	// A single client for connections to twilio to be reused, its timeout covers reading responses
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Keep enough idle connections for concurrent sends not to go through TLS handshakes again
+	transport.MaxIdleConns = parseUint(config.TwilioIdleConns, 16)
+	transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+	transport.IdleConnTimeout = parseDuration(config.TwilioIdleTimeout, 90*time.Second)
+	serv.twilioClient = &http.Client{Timeout: parseDuration(config.TwilioTimeout, 10*time.Second), Transport: transport}
+	serv.concurrency = parseUint(config.Concurrency, 4)
+	// Twilio channels default to the TWILIO_ settings, the others to no retries
+	twilioSettings := ChannelSettings{
+		Retries:    parseUint(config.TwilioRetries, 3),
+		RetryDelay: parseDuration(config.TwilioRetryDelay, 500*time.Millisecond),
+		Timeout:    serv.twilioClient.Timeout,
+	}
+	otherSettings := ChannelSettings{RetryDelay: twilioSettings.RetryDelay, Timeout: 10 * time.Second}
+	serv.channels = map[string]ChannelSettings{
+		"sms":      parseChannelSettings(config.SmsRetries, config.SmsRetryDelay, config.SmsTimeout, twilioSettings, transport),
+		"whatsapp": parseChannelSettings(config.WhatsappRetries, config.WhatsappRetryDelay, config.WhatsappTimeout, twilioSettings, transport),
+		"call":     parseChannelSettings(config.VoiceRetries, config.VoiceRetryDelay, config.VoiceTimeout, twilioSettings, transport),
+		"email":    parseChannelSettings(config.SmtpRetries, config.SmtpRetryDelay, config.SmtpTimeout, otherSettings, nil),
+		"webhook":  parseChannelSettings(config.WebhookRetries, config.WebhookRetryDelay, config.WebhookTimeout, otherSettings, nil),
+	}
+	if config.NotifyWebhookUrl != "" {
+		serv.notifiers = append(serv.notifiers, webhookNotifier{serv.channelSettings("webhook"), config.NotifyWebhookUrl})
+	}
+	if maxConns := parseUint(config.TwilioMaxConns, 0); maxConns > 0 {
+		serv.twilioSlots = make(chan struct{}, maxConns)
+	}
+
+	serv.shortCache = cache.New(shortCacheTTL, 10*time.Minute)
 	serv.longCache = cache.New(cache.NoExpiration, 0)
+	serv.longCachePath = config.LongCacheFile
+	serv.unknownTeams = cache.New(unknownTeamTTL, 10*time.Minute)
+	serv.lookups = &LookupCounts{counts: make(map[string]int)}
+	serv.sheetsClient = &SheetsClient{}
+	serv.spreadsheets, _ = parseSpreadsheets(config.GoogleSheetId)
+	serv.google.SpreadsheetId = serv.spreadsheets[0].Id
+	serv.ctx, serv.stop = context.WithCancel(context.Background())
+	serv.stopping = make(chan struct{})
+	serv.strictTeams = parseBool(config.SheetCaseSensitive, false)
+	// Aliases match labels the way teams do, regardless of case and padding
+	serv.teamAliases = make(map[string]string)
+	for alias, team := range parseStringMap(config.TeamAliases) {
+		serv.teamAliases[serv.teamKey(alias)] = team
+	}
+	serv.testNumbers = parseList(config.TestNumbers)
+	if config.ScheduleTimezone != "" {
+		serv.scheduleLocation, _ = time.LoadLocation(config.ScheduleTimezone)
+	}
+	if serv.lookupLabel == "" {
+		serv.lookupLabel = "team"
+	}
+	serv.perAlertTeams = make(map[string]bool)
+	for _, team := range parseList(config.PerAlertTeams) {
+		serv.perAlertTeams[serv.teamKey(team)] = true
+	}
+	serv.teamColumn = strings.ToLower(strings.TrimSpace(config.SheetTeamColumn))
+	serv.phoneColumns = parseList(strings.ToLower(config.SheetPhoneColumns))
+	serv.restoreLongCache()
+	serv.dailyCap = parseUint(config.DailyCap, 0)
+	serv.maxRecipients = parseUint(config.MaxRecipients, defaultMaxRecipients)
+	serv.strictRecipients = parseBool(config.StrictRecipients, false)
+	serv.appendLabelNumbers = config.PhoneLabelMode == "append"
+	serv.dailyCounts = cache.New(25*time.Hour, time.Hour)
+	serv.rateLimit = parseUint(config.RateLimit, 0)
+	serv.rateLimitKey = config.RateLimitKey
+	if serv.rateLimitKey == "" {
+		serv.rateLimitKey = "team"
+	}
+	serv.rateBuckets = cache.New(time.Minute, 10*time.Minute)
+	serv.dedupCache = cache.New(serv.dedupWindow, 10*time.Minute)
+	serv.lookupEnabled = parseBool(config.LookupEnabled, false)
+	serv.lookupLineTypes = parseList(config.LookupLineTypes)
+	serv.lookupCache = cache.New(lookupTTL, time.Hour)
+	serv.receipts = cache.New(receiptsTTL, time.Hour)
+	serv.twilioSigningToken = config.TwilioAccountToken
+	if serv.twilioSigningToken == "" {
+		serv.twilioSigningToken = config.TwilioAuthToken
+	}
 
+	if interval := parseDuration(config.SheetRefreshInterval, 0); interval > 0 {
+		go serv.refreshPeriodically(interval)
+	}
 	return serv
 }
 
@@ -112,49 +659,128 @@ func (serv *Server) webhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !serv.allowedSource(w, r) {
+		return
+	}
+
+	body, ok := serv.readAuthenticatedBody(w, r)
+	if !ok {
+		return
+	}
+
 	var alerts template.Data
-	err := json.NewDecoder(r.Body).Decode(&alerts)
+	err := json.Unmarshal(body, &alerts)
 	if err != nil {
 		logMessage(fmt.Sprintf("Error parsing alerts content: %s", err.Error()))
 		asJson(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	err = checkPayload(body)
+	if err != nil {
+		logMessage(err.Error())
+		asJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	for _, alert := range alerts.Alerts {
-		team := alert.Labels["team"]
-		message := fmt.Sprintf("%s: %s", alert.Status, alert.Annotations["summary"])
-		recipients, err := getPhonesFromLabel(alert.Labels["phone_numbers"])
-		if err != nil {
-			logMessage(fmt.Sprintf("Cannot use label-provided phone numbers %s: %s", alert.Labels["phone_numbers"], err.Error()))
+	var report Report
+	if serv.webhookDeadline > 0 {
+		// Past the deadline, leave the remaining sends to the background rather than having Alertmanager retry
+		done := make(chan Report, 1)
+		go func() {
+			// Sends outlive the request past the deadline, only shutting down stops them
+			done <- serv.processAlerts(withRequestSpan(serv.ctx, r.Context()), alerts)
+		}()
+		select {
+		case report = <-done:
+		case <-time.After(serv.webhookDeadline):
+			log.Printf("Webhook deadline of %s reached, completing sends in the background", serv.webhookDeadline)
+			// Alertmanager will not see the outcome, it is only logged
+			go func() {
+				late := <-done
+				log.Printf("Sends completed in the background after the webhook deadline: %d alerts sent, %d failed, %d skipped", len(late.Sent), len(late.Failed), len(late.Skipped))
+				late.logFailures("After the webhook deadline")
+			}()
+			asJson(w, http.StatusOK, "accepted, remaining SMS are being sent in the background")
+			return
 		}
+	} else {
+		report = serv.processAlerts(r.Context(), alerts)
+	}
 
-		if recipients == nil {
-			recipients, err = serv.getTeamNumbers(team)
-			if err != nil {
-				logMessage(err.Error())
-				asJson(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+	// Only have Alertmanager retry when nothing went through, retrying would page again the people already reached
+	if report.allFailed() {
+		asJson(w, http.StatusInternalServerError, report)
+		return
+	}
+	asJson(w, http.StatusOK, report)
+}
+
+// Process every alert of a notification, firing ones first unless resolved alerts have the same priority
+func (serv *Server) processAlerts(ctx context.Context, alerts template.Data) Report {
+	if serv.resolvedPriority == "" || serv.resolvedPriority == "normal" {
+		return serv.processBatch(ctx, alerts)
+	}
+
+	firing, resolved := alerts, alerts
+	firing.Alerts = alerts.Alerts.Firing()
+	resolved.Alerts = alerts.Alerts.Resolved()
+	report := serv.processBatch(ctx, firing)
+	if serv.resolvedPriority == "background" {
+		go func() {
+			serv.processBatch(serv.ctx, resolved).logFailures("In the background")
+		}()
+		return report
+	}
+	report.merge(serv.processBatch(ctx, resolved))
+	return report
+}
+
+// Process every alert of a batch, going on when some of them fail
+func (serv *Server) processBatch(ctx context.Context, alerts template.Data) Report {
+	if serv.coalesce {
+		return serv.processCoalesced(ctx, alerts)
+	}
+
+	report := newReport()
+	for _, alert := range alerts.Alerts {
+		if serv.holdFlapping(alert, alerts.Receiver) {
+			report.skip(alert, Delivery{}, heldReason(alert))
+			continue
+		}
+		if serv.skipResolved(alert) {
+			report.skip(alert, Delivery{}, errResolvedSkipped)
+			continue
 		}
 
-		for _, recipient := range recipients {
-			err := sendSms(serv.twilio, fmt.Sprintf("+%v", recipient), message)
-			if err != nil {
-				logMessage(err.Error())
-				asJson(w, http.StatusInternalServerError, err.Error())
-				return
-			}
+		delivery, sent, deduplicated, err := serv.processAlert(ctx, alert, alerts.Receiver)
+		report.Deduplicated += deduplicated
+		if err == errDropped || err == errRateLimited || err == errSuppressed {
+			report.skip(alert, delivery, err)
+			continue
 		}
+		report.add(alert, delivery, sent > 0, err)
 	}
-	asJson(w, http.StatusOK, "success")
+	return report
 }
 
-func getPhonesFromLabel(phoneNumbers string) ([]interface{}, error) {
+func getPhonesFromLabel(phoneNumbers string, region string) ([]interface{}, error) {
 	if phoneNumbers == "" {
 		return nil, nil
 	}
 
-	phonesPattern := "^[1-9]\\d{1,14}(,[1-9]\\d{1,14})*$"
+	// Numbers are normalized before sending when a region is set, only split them here
+	if region != "" {
+		var phonesList []interface{}
+		for _, v := range strings.Split(phoneNumbers, ",") {
+			if strings.TrimSpace(v) != "" {
+				phonesList = append(phonesList, v)
+			}
+		}
+		return phonesList, nil
+	}
+
+	// Numbers may be written in E.164, formatPhone adds the + back before sending
+	phonesPattern := "^\\+?[1-9]\\d{1,14}(,\\+?[1-9]\\d{1,14})*$"
 	res, err := regexp.MatchString(phonesPattern, phoneNumbers)
 	if err != nil {
 		return nil, err
@@ -166,81 +792,248 @@ func getPhonesFromLabel(phoneNumbers string) ([]interface{}, error) {
 	split := strings.Split(phoneNumbers, ",")
 	phonesList := make([]interface{}, len(split))
 	for i, v := range split {
-		phonesList[i] = v
+		phonesList[i] = strings.TrimPrefix(v, "+")
 	}
 	return phonesList, nil
 }
 
+// Get the key a team is cached under, team labels matching Sheet rows regardless of case and padding unless matching is strict
+func (serv *Server) teamKey(team string) string {
+	if serv.strictTeams {
+		return team
+	}
+	return strings.ToLower(strings.TrimSpace(team))
+}
+
 // Get team on-call phone number present on google sheet, use fallback cache if googleapi down
-func (serv *Server) getTeamNumbers(team string) ([]interface{}, error) {
-	phoneNumbers, found := serv.shortCache.Get(team)
+func (serv *Server) getTeamNumbers(ctx context.Context, spreadsheet Spreadsheet, team string) (Team, error) {
+	defer finishSpan(startSpan(ctx, "sheet.lookup", team))
+	entry, err := serv.readTeam(ctx, spreadsheet, team)
+	if err != nil {
+		return entry, err
+	}
+	return serv.onCall(team, entry), nil
+}
+
+// Get a team's row from the caches, reading the Sheet when it is not cached
+func (serv *Server) readTeam(ctx context.Context, spreadsheet Spreadsheet, team string) (Team, error) {
+	key := spreadsheet.teamKey(serv.teamKey(team))
+	entry, found := serv.shortCache.Get(key)
 	if found {
-		return phoneNumbers.([]interface{}), nil
+		serv.countLookup("hit")
+		return entry.(Team), nil
 	}
 
+	if _, unknown := serv.unknownTeams.Get(key); unknown {
+		serv.countLookup("unknown")
+		return Team{}, errors.New(fmt.Sprintf("No row found in Sheet for team %s (cached)", team))
+	}
+
+	serv.countLookup("miss")
 	log.Printf("Getting numbers for team \"%s\" from Sheet", team)
-	sheets, err := NewSpreadsheetService(serv.google.TokenPath)
+	// Concurrent cache misses share a single Sheet read
+	_, err := serv.readSpreadsheet(ctx, spreadsheet)
+	if err == errEmptySheet {
+		return Team{}, err
+	}
+	// The request is given up, the fallback cache is for when the Sheet cannot be read
+	if err != nil && err == ctx.Err() {
+		return Team{}, err
+	}
 	if err != nil {
-		logMessage(fmt.Sprintf("Cannot create Sheets service, reading from fallback cache - %s", err.Error()))
-		phoneNumbers, found := serv.longCache.Get(team)
+		logMessage(fmt.Sprintf("%s, reading from fallback cache", err.Error()))
+		serv.countLookup("fallback")
+		entry, found := serv.longCache.Get(key)
 		if found {
-			return phoneNumbers.([]interface{}), nil
+			fallback := entry.(Team)
+			sheetFallbackServed.Inc()
+			age := "at an unknown time"
+			if !fallback.ReadAt.IsZero() {
+				age = time.Since(fallback.ReadAt).Round(time.Second).String() + " ago"
+			}
+			log.Printf("WARN - serving possibly stale numbers of team \"%s\" from fallback cache, read from the Sheet %s", team, age)
+			return fallback, nil
 		} else {
-			return nil, errors.New(fmt.Sprintf("No numbers found in fallback cache for team %s", team))
+			return Team{}, errors.New(fmt.Sprintf("No numbers found in fallback cache for team %s", team))
 		}
 	}
 
-	resp, err := sheets.Spreadsheets.Values.Get(serv.google.SpreadsheetId, readRange).Do()
-	if err != nil {
-		logMessage(fmt.Sprintf("Cannot read Sheet, reading from fallback cache - %s", err.Error()))
-		phoneNumbers, found := serv.longCache.Get(team)
-		if found {
-			return phoneNumbers.([]interface{}), nil
-		} else {
-			return nil, errors.New(fmt.Sprintf("No numbers found in fallback cache for team %s", team))
+	entry, found = serv.shortCache.Get(key)
+	if found {
+		return entry.(Team), nil
+	}
+	log.Printf("No row found in Sheet for team \"%s\", not reading the Sheet again for it for %s", team, unknownTeamTTL)
+	serv.unknownTeams.Set(key, true, cache.DefaultExpiration)
+	return Team{}, errors.New(fmt.Sprintf("No row found in Sheet for team %s", team))
+}
+
+// Read the google sheet, trying again on temporary failures or empty results before giving up
+func (serv *Server) readSheetWithRetries(ctx context.Context, spreadsheet Spreadsheet) (int, error) {
+	delay := serv.sheetRetryDelay
+	for attempt := 0; ; attempt++ {
+		teams, err := serv.readSheet(ctx, spreadsheet)
+		if err == nil || attempt >= serv.sheetRetries || !retryableSheetError(err) {
+			return teams, err
 		}
-		return nil, err
+		log.Printf("%s, retrying in %s (attempt %d of %d)", err.Error(), delay, attempt+1, serv.sheetRetries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return teams, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// Read every team's phone numbers from the google sheet into the caches, returns the number of teams read
+func (serv *Server) readSheet(ctx context.Context, spreadsheet Spreadsheet) (int, error) {
+	sheets, err := serv.sheetsService()
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Cannot create Sheets service - %s", err.Error()))
+	}
+
+	resp, err := sheets.Spreadsheets.Values.Get(spreadsheet.Id, serv.readRange()).Context(ctx).Do()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusForbidden && serv.google.Subject != "" {
+		return 0, errors.New(fmt.Sprintf("Cannot read Sheet - user %s impersonated by service account %s lacks access to spreadsheet %s, share it with this user and make sure the Sheets API is enabled for the account's project (%s)",
+			serv.google.Subject, serviceAccountEmail(serv.google), spreadsheet.Id, gerr.Message))
+	}
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusForbidden {
+		return 0, errors.New(fmt.Sprintf("Cannot read Sheet - service account %s lacks access to spreadsheet %s, share it with this account and make sure the Sheets API is enabled for its project (%s)",
+			serviceAccountEmail(serv.google), spreadsheet.Id, gerr.Message))
+	}
+	if err != nil {
+		return 0, newSheetError(err)
 	}
 
 	if len(resp.Values) == 0 {
-		return nil, errors.New("Sheet appears to be empty :(")
+		return 0, errEmptySheet
 	}
 
+	var header map[int]string
+	if serv.headerRow > 0 {
+		header, err = serv.readHeader(ctx, sheets, spreadsheet.Id)
+		if err != nil {
+			return 0, newSheetError(err)
+		}
+	}
+	columns, err := serv.findColumns(header)
+	if err != nil {
+		return 0, err
+	}
+
+	windows := serv.scheduleWindows(header)
+	teams := 0
+	readAt := time.Now()
 	for _, row := range resp.Values {
-		if len(row) > 0 {
-			serv.longCache.Set(row[0].(string), row[1:], cache.DefaultExpiration)
-			serv.shortCache.Set(row[0].(string), row[1:], cache.DefaultExpiration)
-			if row[0] == team {
-				return row[1:], nil
+		if len(row) == 0 {
+			continue
+		}
+		if name := serv.rowName(row, columns); name != "" {
+			if !serv.rowActive(row) {
+				log.Printf("Skipping inactive row for team \"%s\"", name)
+				continue
 			}
+			entry := serv.rowTeam(name, row, columns, windows)
+			entry.Tiers = teamTiers(entry, header)
+			entry.ReadAt = readAt
+			key := spreadsheet.teamKey(serv.teamKey(name))
+			serv.longCache.Set(key, entry, cache.DefaultExpiration)
+			serv.shortCache.Set(key, entry, cache.DefaultExpiration)
+			teams++
 		}
 	}
+	serv.health.sheetRead()
+	serv.saveLongCache()
+	return teams, nil
+}
+
+// Get the service account's token, given inline or else read from its file
+func (credentials GoogleCredentials) token() ([]byte, error) {
+	if credentials.TokenJson != "" {
+		return []byte(credentials.TokenJson), nil
+	}
+	return ioutil.ReadFile(credentials.TokenPath)
+}
 
-	return nil, errors.New(fmt.Sprintf("No row found in Sheet for team %s", team))
+// Get the service account's email address from its token, for error messages
+func serviceAccountEmail(credentials GoogleCredentials) string {
+	var token struct {
+		ClientEmail string `json:"client_email"`
+	}
+	content, err := credentials.token()
+	if err != nil || json.Unmarshal(content, &token) != nil || token.ClientEmail == "" {
+		if credentials.TokenJson != "" {
+			return "from GOOGLE_CREDENTIALS_JSON"
+		}
+		return "from " + credentials.TokenPath
+	}
+	return token.ClientEmail
 }
 
-func NewSpreadsheetService(client_secret_path string) (*sheets.Service, error) {
+func NewSpreadsheetService(credentials GoogleCredentials) (*sheets.Service, error) {
 	ctx := context.Background()
-	srv, err := sheets.NewService(ctx, option.WithCredentialsFile(client_secret_path), option.WithScopes(sheets.SpreadsheetsScope))
+	if credentials.Subject != "" {
+		return newDelegatedSpreadsheetService(ctx, credentials)
+	}
+	token := option.WithCredentialsFile(credentials.TokenPath)
+	if credentials.TokenJson != "" {
+		token = option.WithCredentialsJSON([]byte(credentials.TokenJson))
+	}
+	srv, err := sheets.NewService(ctx, token, option.WithScopes(sheets.SpreadsheetsScope))
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Unable to establish Sheets Client: %s", err.Error()))
 	}
 	return srv, nil
 }
 
-// Send message to recipient through twilio API
-func sendSms(twilio TwilioCredentials, recipient string, message string) error {
-	log.Printf("Sending SMS to %s: %s", recipient, message)
+// Create a Sheets service reading as the Workspace user the service account impersonates through domain-wide delegation
+func newDelegatedSpreadsheetService(ctx context.Context, credentials GoogleCredentials) (*sheets.Service, error) {
+	token, err := credentials.token()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to read service account token: %s", err.Error()))
+	}
+	config, err := google.JWTConfigFromJSON(token, sheets.SpreadsheetsScope)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to impersonate %s, expecting a service account token: %s", credentials.Subject, err.Error()))
+	}
+	config.Subject = credentials.Subject
+	srv, err := sheets.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx)))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to establish Sheets Client: %s", err.Error()))
+	}
+	return srv, nil
+}
 
-	urlStr := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", twilio.AccountSid)
+// Send message to recipient through twilio API, as a WhatsApp message when channel is "whatsapp"
+func sendSms(ctx context.Context, client *http.Client, twilio TwilioCredentials, channel string, recipient string, message string) (string, error) {
+	from := twilio.FromNumber
+	if channel == "whatsapp" {
+		log.Printf("Sending WhatsApp message to %s: %s", recipient, message)
+		// WhatsApp goes through the same API, numbers being prefixed
+		recipient = "whatsapp:" + recipient
+		if twilio.WhatsappFromNumber != "" {
+			from = twilio.WhatsappFromNumber
+		}
+		from = "whatsapp:" + from
+	} else {
+		log.Printf("Sending SMS to %s: %s", recipient, message)
+	}
+
+	urlStr := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", twilio.ApiBaseUrl, twilio.AccountSid)
 	msgData := url.Values{}
 	msgData.Set("To", recipient)
-	msgData.Set("From", twilio.FromNumber)
+	if twilio.MessagingServiceSid != "" {
+		msgData.Set("MessagingServiceSid", twilio.MessagingServiceSid)
+	} else {
+		msgData.Set("From", from)
+	}
 	msgData.Set("Body", message)
+	if twilio.StatusCallback != "" {
+		msgData.Set("StatusCallback", twilio.StatusCallback)
+	}
 	msgDataReader := *strings.NewReader(msgData.Encode())
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", urlStr, &msgDataReader)
+	req, _ := http.NewRequestWithContext(ctx, "POST", urlStr, &msgDataReader)
 	req.SetBasicAuth(twilio.AuthSid, twilio.AuthToken)
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
@@ -249,20 +1042,24 @@ func sendSms(twilio TwilioCredentials, recipient string, message string) error {
 
 	if err != nil {
 		log.Printf("Error querying twilio API: %s", err.Error())
-		return err
-	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := ioutil.ReadAll(resp.Body)
-		return errors.New(fmt.Sprintf("Non-200 response from twilio API: %s - %s", resp.Status, body))
+		log.Printf("Error response from twilio API: %s", body)
+		return "", newTwilioError(resp, body)
 	}
 
 	var data map[string]interface{}
 	err = json.NewDecoder(resp.Body).Decode(&data)
 	if err != nil {
 		log.Printf("Error in twilio response body: %s", err.Error())
-		return err
+		return "", err
 	}
-	log.Printf("Successfully sent SMS - SID %s", data["sid"])
-	return nil
+	sid, _ := data["sid"].(string)
+	log.Printf("Successfully sent SMS - SID %s", sid)
+	return sid, nil
 }
 
 func main() {
@@ -270,46 +1067,121 @@ func main() {
 	_ = validate.RegisterValidation("phone", func(fl validator.FieldLevel) bool {
 		return regexpPhone.MatchString(fl.Field().String())
 	})
+	_ = validate.RegisterValidation("phones", func(fl validator.FieldLevel) bool {
+		for _, phone := range parseList(fl.Field().String()) {
+			if !regexpPhone.MatchString(phone) {
+				return false
+			}
+		}
+		return true
+	})
 	_ = validate.RegisterValidation("twiliosid", func(fl validator.FieldLevel) bool {
 		return regexpTwilioSid.MatchString(fl.Field().String())
 	})
-	_ = validate.RegisterValidation("sheetid", func(fl validator.FieldLevel) bool {
-		return regexpSheetId.MatchString(fl.Field().String())
+	_ = validate.RegisterValidation("messagingsid", func(fl validator.FieldLevel) bool {
+		return regexpMessagingServiceSid.MatchString(fl.Field().String())
+	})
+	_ = validate.RegisterValidation("sheetids", func(fl validator.FieldLevel) bool {
+		_, err := parseSpreadsheets(fl.Field().String())
+		return err == nil
+	})
+	_ = validate.RegisterValidation("timezone", func(fl validator.FieldLevel) bool {
+		_, err := time.LoadLocation(fl.Field().String())
+		return err == nil
+	})
+	_ = validate.RegisterValidation("labelname", func(fl validator.FieldLevel) bool {
+		return regexpLabelName.MatchString(fl.Field().String())
+	})
+	_ = validate.RegisterValidation("basepath", func(fl validator.FieldLevel) bool {
+		return regexpBasePath.MatchString(fl.Field().String())
+	})
+	_ = validate.RegisterValidation("boolean", func(fl validator.FieldLevel) bool {
+		_, err := strconv.ParseBool(fl.Field().String())
+		return err == nil
+	})
+	_ = validate.RegisterValidation("uint", func(fl validator.FieldLevel) bool {
+		parsed, err := strconv.Atoi(fl.Field().String())
+		return err == nil && parsed >= 0
+	})
+	_ = validate.RegisterValidation("ratio", func(fl validator.FieldLevel) bool {
+		parsed, err := strconv.ParseFloat(fl.Field().String(), 64)
+		return err == nil && parsed >= 0 && parsed <= 1
+	})
+	_ = validate.RegisterValidation("smslength", func(fl validator.FieldLevel) bool {
+		parsed, err := strconv.Atoi(fl.Field().String())
+		return err == nil && parsed >= minMessageLength && parsed <= maxMessageLength
+	})
+	_ = validate.RegisterValidation("duration", func(fl validator.FieldLevel) bool {
+		_, err := time.ParseDuration(fl.Field().String())
+		return err == nil
+	})
+	_ = validate.RegisterValidation("column", func(fl validator.FieldLevel) bool {
+		return regexpColumn.MatchString(fl.Field().String()) && fl.Field().String() != "A"
+	})
+	_ = validate.RegisterValidation("gotemplate", func(fl validator.FieldLevel) bool {
+		_, err := texttemplate.New("").Parse(fl.Field().String())
+		return err == nil
+	})
+	_ = validate.RegisterValidation("stringmap", func(fl validator.FieldLevel) bool {
+		var parsed map[string]string
+		return json.Unmarshal([]byte(fl.Field().String()), &parsed) == nil
+	})
+	_ = validate.RegisterValidation("countrycodes", func(fl validator.FieldLevel) bool {
+		return regexpCountryCodes.MatchString(fl.Field().String())
+	})
+	_ = validate.RegisterValidation("sheetrange", func(fl validator.FieldLevel) bool {
+		return validSheetRange(fl.Field().String())
+	})
+	_ = validate.RegisterValidation("a1range", func(fl validator.FieldLevel) bool {
+		return regexpA1Range.MatchString(fl.Field().String())
+	})
+	_ = validate.RegisterValidation("sentrydsn", func(fl validator.FieldLevel) bool {
+		return validSentryDsn(fl.Field().String())
+	})
+	_ = validate.RegisterValidation("cidrs", func(fl validator.FieldLevel) bool {
+		for _, cidr := range parseList(fl.Field().String()) {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return false
+			}
+		}
+		return true
 	})
 	_ = validate.RegisterValidation("port", func(fl validator.FieldLevel) bool {
 		return regexpPort.MatchString(fl.Field().String())
 	})
+	_ = validate.RegisterValidation("callable", func(fl validator.FieldLevel) bool {
+		// Calls cannot go through a Messaging Service
+		return !parseBool(fl.Field().String(), false) || fl.Top().FieldByName("TwilioFromNumber").String() != ""
+	})
+	_ = validate.RegisterValidation("authenticated", func(fl validator.FieldLevel) bool {
+		// Endpoints exposing numbers or sending messages must not be open to anyone
+		top := fl.Top()
+		return !parseBool(fl.Field().String(), false) || top.FieldByName("BasicAuthUser").String() != "" || top.FieldByName("WebhookSecret").String() != ""
+	})
+	_ = validate.RegisterValidation("severitypolicies", func(fl validator.FieldLevel) bool {
+		top := fl.Top()
+		return validSeverityPolicies(fl.Field().String(), top.FieldByName("EmailGateway").String(), parseBool(top.FieldByName("VoiceEnabled").String(), false))
+	})
 
-	config := Config{
-		TwilioAccountSid: os.Getenv("TWILIO_ACCOUNT_SID"),
-		TwilioAuthSid:    os.Getenv("TWILIO_AUTH_SID"),
-		TwilioAuthToken:  os.Getenv("TWILIO_AUTH_TOKEN"),
-		TwilioFromNumber: os.Getenv("TWILIO_FROM_NUMBER"),
-		GoogleSheetId:    os.Getenv("GOOGLE_SHEET_ID"),
-		GoogleTokenPath:  os.Getenv("GOOGLE_TOKEN_PATH"),
-		ListenPort:       os.Getenv("PORT"),
-		SentryDsn:        os.Getenv("SENTRY_DSN"),
-	}
+	config := readConfig()
 
 	err := validate.Struct(config)
 	if err != nil {
 		for _, e := range err.(validator.ValidationErrors) {
-			log.Println(e)
+			log.Println(describeConfigError(e))
 		}
 		log.Fatal("Parameters validation failed")
 	}
 
+	sentryFlushTimeout := parseDuration(config.SentryFlushTimeout, 5*time.Second)
 	if config.SentryDsn != "" {
-		err := sentry.Init(sentry.ClientOptions{
-			Dsn: config.SentryDsn,
-		})
+		err := initSentry(config.SentryDsn, parseUint(config.SentryMaxFailures, 5), parseRatio(config.SentryTracesRate))
 		if err != nil {
 			log.Fatal(fmt.Sprintf("Sentry initialization failed DSN %s", config.SentryDsn))
 		}
 		log.Printf("Sentry initialized with DSN %s", config.SentryDsn)
-		defer sentry.Flush(time.Second * 5)
+		defer sentry.Flush(sentryFlushTimeout)
 		defer sentry.Recover()
-		useSentry = true
 	} else {
 		log.Println("Not using Sentry")
 	}
@@ -321,7 +1193,58 @@ func main() {
 		listenAddress = fmt.Sprintf(":%s", config.ListenPort)
 	}
 
-	log.Printf("listening on: %s", listenAddress)
+	log.Printf("listening on: %s%s", listenAddress, serv.basePath)
+	if serv.dryRun {
+		log.Println("DRY RUN - messages are logged instead of being sent")
+	}
+	// Dry runs may have no access to twilio at all
+	if parseBool(config.CheckSenders, false) && !serv.dryRun {
+		serv.checkSenders(parseBool(config.StrictStartup, false))
+	}
+
+	server := &http.Server{Addr: listenAddress, Handler: serv, BaseContext: func(net.Listener) context.Context { return serv.ctx }}
+	shutdownTimeout := parseDuration(config.ShutdownTimeout, 15*time.Second)
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		received := <-signals
+		log.Printf("Received %s, waiting up to %s for in-flight requests", received, shutdownTimeout)
+		close(serv.stopping)
+		released := serv.releaseHeldAlerts()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logMessage(fmt.Sprintf("Some requests were still in flight at shutdown: %s", err.Error()))
+		}
+		// Held alerts left are canceled along with the other calls, each failure being logged
+		select {
+		case <-released:
+		case <-ctx.Done():
+			logMessage("Some alerts held by the grace window were still being sent at shutdown")
+		}
+		serv.stop()
+		close(stopped)
+	}()
 
-	log.Fatal(http.ListenAndServe(listenAddress, serv))
+	if config.TlsCertFile != "" {
+		log.Printf("Serving HTTPS with certificate %s", config.TlsCertFile)
+		err = server.ListenAndServeTLS(config.TlsCertFile, config.TlsKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		<-stopped
+		log.Println("Server stopped")
+		return
+	}
+
+	logMessage(fmt.Sprintf("Server stopped: %s", err.Error()))
+	// Deferred calls do not run on exit, deliver the error reports first
+	if usingSentry() && !sentry.Flush(sentryFlushTimeout) {
+		log.Printf("Some Sentry events could not be sent within %s", sentryFlushTimeout)
+	}
+	os.Exit(1)
 }
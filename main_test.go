@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func TestGetPhonesFromLabel(t *testing.T) {
+	tests := []struct {
+		label  string
+		region string
+		want   []string
+	}{
+		{"", "", nil},
+		{"33611111111", "", []string{"+33611111111"}},
+		{"+33611111111", "", []string{"+33611111111"}},
+		{"+33611111111,33622222222", "", []string{"+33611111111", "+33622222222"}},
+		{"+33611111111", "FR", []string{"+33611111111"}},
+		{"33611111111", "FR", []string{"+33611111111"}},
+		{"+33611111111, 0622222222", "FR", []string{"+33611111111", "+33622222222"}},
+	}
+	for _, test := range tests {
+		phones, err := getPhonesFromLabel(test.label, test.region)
+		if err != nil {
+			t.Errorf("getPhonesFromLabel(%q, %q) failed: %s", test.label, test.region, err)
+			continue
+		}
+
+		// Label numbers are formatted like the Sheet's before sending
+		var got []string
+		for _, phone := range phones {
+			var formatted string
+			if test.region != "" {
+				formatted, err = normalizePhone(fmt.Sprint(phone), test.region)
+			} else {
+				formatted, err = formatPhone(fmt.Sprint(phone))
+			}
+			if err != nil {
+				t.Errorf("getPhonesFromLabel(%q, %q) gave unusable number %v: %s", test.label, test.region, phone, err)
+			}
+			got = append(got, formatted)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("getPhonesFromLabel(%q, %q) = %v, want %v", test.label, test.region, got, test.want)
+		}
+	}
+}
+
+func TestGetPhonesFromLabelInvalid(t *testing.T) {
+	for _, label := range []string{"abc", "++33611111111", "33611111111;33622222222", "+33611111111,"} {
+		if phones, err := getPhonesFromLabel(label, ""); err == nil {
+			t.Errorf("getPhonesFromLabel(%q, \"\") = %v, want an error", label, phones)
+		}
+	}
+}
+
+func newTeamsTestServer(strict bool) *Server {
+	return &Server{
+		strictTeams:  strict,
+		shortCache:   cache.New(shortCacheTTL, 0),
+		longCache:    cache.New(cache.NoExpiration, 0),
+		unknownTeams: cache.New(unknownTeamTTL, 0),
+		lookups:      &LookupCounts{counts: make(map[string]int)},
+	}
+}
+
+func TestTeamKey(t *testing.T) {
+	serv := newTeamsTestServer(false)
+	for _, team := range []string{"ops", "OPS", "Ops", " Ops ", "\tops\n"} {
+		if got := serv.teamKey(team); got != "ops" {
+			t.Errorf("teamKey(%q) = %q, want \"ops\"", team, got)
+		}
+	}
+	if got := (Spreadsheet{Env: "prod"}).teamKey(serv.teamKey(" Ops ")); got != "prod/ops" {
+		t.Errorf("teamKey of \" Ops \" in env prod = %q, want \"prod/ops\"", got)
+	}
+
+	strict := newTeamsTestServer(true)
+	if got := strict.teamKey(" Ops "); got != " Ops " {
+		t.Errorf("strict teamKey(\" Ops \") = %q, want it unchanged", got)
+	}
+}
+
+func TestReadTeamMatchesCaseAndPadding(t *testing.T) {
+	for _, sheetName := range []string{" Ops ", "OPS", "ops"} {
+		serv := newTeamsTestServer(false)
+		spreadsheet := Spreadsheet{Id: "sheet"}
+		// Cached the way readSheet caches the rows of the Sheet
+		serv.shortCache.Set(spreadsheet.teamKey(serv.teamKey(sheetName)), Team{Numbers: []interface{}{"33611111111"}}, cache.DefaultExpiration)
+
+		for _, label := range []string{" Ops ", "OPS", "ops", "Ops"} {
+			team, err := serv.readTeam(context.Background(), spreadsheet, label)
+			if err != nil {
+				t.Errorf("readTeam(%q) with row %q failed: %s", label, sheetName, err)
+				continue
+			}
+			if len(team.Numbers) != 1 {
+				t.Errorf("readTeam(%q) with row %q = %v, want the row's numbers", label, sheetName, team.Numbers)
+			}
+		}
+	}
+}
+
+func TestReadTeamKeepsEnvsApart(t *testing.T) {
+	serv := newTeamsTestServer(false)
+	prod := Spreadsheet{Env: "prod", Id: "prod-sheet"}
+	serv.shortCache.Set(prod.teamKey(serv.teamKey("Ops")), Team{Numbers: []interface{}{"33611111111"}}, cache.DefaultExpiration)
+
+	if _, err := serv.readTeam(context.Background(), prod, " OPS "); err != nil {
+		t.Errorf("readTeam(\" OPS \") in env prod failed: %s", err)
+	}
+	// Teams of other envs are unknown rather than read from the Sheet
+	serv.unknownTeams.Set((Spreadsheet{Id: "default-sheet"}).teamKey("ops"), true, cache.DefaultExpiration)
+	if _, err := serv.readTeam(context.Background(), Spreadsheet{Id: "default-sheet"}, "Ops"); err == nil {
+		t.Errorf("readTeam(\"Ops\") in the default env found the prod team")
+	}
+}
+
+func TestReadTeamGivesUpWithRequest(t *testing.T) {
+	serv := newTeamsTestServer(false)
+	serv.ctx = context.Background()
+	spreadsheet := Spreadsheet{Id: "sheet"}
+	// A Sheet read still going on, which lookups share
+	started, release := make(chan struct{}), make(chan struct{})
+	go serv.sheetReads.Do(spreadsheet.Id, func() (interface{}, error) {
+		close(started)
+		<-release
+		return 0, nil
+	})
+	defer close(release)
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := serv.readTeam(ctx, spreadsheet, "ops"); err != context.Canceled {
+		t.Errorf("readTeam with a cancelled request = %v, want %v", err, context.Canceled)
+	}
+	if _, unknown := serv.unknownTeams.Get(spreadsheet.teamKey("ops")); unknown {
+		t.Errorf("readTeam with a cancelled request marked the team unknown")
+	}
+}
+
+func TestSendStopsWithRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var requests int32
+	// Twilio saturated, cancelling the request while the send is retried
+	twilio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer twilio.Close()
+
+	serv := &Server{
+		twilio:   TwilioCredentials{AccountSid: "AC00", FromNumber: "+33600000000", ApiBaseUrl: twilio.URL},
+		channels: map[string]ChannelSettings{"sms": {Retries: 3, RetryDelay: time.Hour, Client: twilio.Client()}},
+	}
+	if _, err := serv.send(ctx, "sms", "+33611111111", "test"); err != context.Canceled {
+		t.Errorf("send with a cancelled request = %v, want %v", err, context.Canceled)
+	}
+	// Requests done are not sent again, nor are later ones sent at all
+	if _, err := serv.send(ctx, "sms", "+33611111111", "test"); err == nil {
+		t.Errorf("send with a cancelled request succeeded")
+	}
+	if requests != 1 {
+		t.Errorf("twilio got %d requests, want 1", requests)
+	}
+}
+
+func TestCanonicalTeamMatchesCaseAndPadding(t *testing.T) {
+	serv := newTeamsTestServer(false)
+	serv.teamAliases = map[string]string{serv.teamKey("Ops"): "infrastructure"}
+	for _, label := range []string{"ops", "OPS", " Ops "} {
+		if got := serv.canonicalTeam(label); got != "infrastructure" {
+			t.Errorf("canonicalTeam(%q) = %q, want \"infrastructure\"", label, got)
+		}
+	}
+	if got := serv.canonicalTeam("dev"); got != "dev" {
+		t.Errorf("canonicalTeam(\"dev\") = %q, want it unchanged", got)
+	}
+}
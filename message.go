@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+)
+
+// Longest message body accepted by twilio, and the default maximum length
+const maxMessageLength = 1600
+
+// Template used to describe alerts without any annotation, from their labels
+const defaultDescriptionTemplate = "{{ .Labels.alertname }}{{ with .Labels.instance }} on {{ . }}{{ end }}{{ with .Labels.severity }} ({{ . }}){{ end }}"
+
+// Data given to message templates, the same whatever the channel
+type TemplateData struct {
+	template.Alert
+	// Team the alert is routed to, after aliases
+	Team string
+	// Alertmanager receiver the alert comes from
+	Receiver string
+	// How long the alert has been firing, or had been when resolved
+	Age time.Duration
+}
+
+func newTemplateData(alert template.Alert, receiver string, team string) TemplateData {
+	end := time.Now()
+	if alert.Status == "resolved" && !alert.EndsAt.IsZero() {
+		end = alert.EndsAt
+	}
+	return TemplateData{
+		Alert:    alert,
+		Team:     team,
+		Receiver: receiver,
+		Age:      end.Sub(alert.StartsAt).Round(time.Second),
+	}
+}
+
+// Get the message template of a team, its own from the Sheet or else the global one, nil when there is none
+func (serv *Server) teamMessageTemplate(team *Team) *texttemplate.Template {
+	if team == nil || team.Template == "" {
+		return serv.messageTemplate
+	}
+	// Templates are checked when the Sheet is read, this is for the ones restored from the fallback cache file
+	parsed, err := texttemplate.New("team").Parse(team.Template)
+	if err != nil {
+		logMessage(fmt.Sprintf("Ignoring invalid message template of a team: %s", err.Error()))
+		return serv.messageTemplate
+	}
+	return parsed
+}
+
+// Build the SMS text sent for an alert, from the message template when there is one,
+// shortening the summary rather than the status to fit in length
+func (serv *Server) composeMessage(data TemplateData, messageTemplate *texttemplate.Template, length int) (string, error) {
+	if messageTemplate != nil {
+		var rendered bytes.Buffer
+		err := messageTemplate.Execute(&rendered, data)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Cannot render message of alert %s: %s", data.Labels["alertname"], err.Error()))
+		}
+		return truncate(serv.withReceiver(data, rendered.String()), length), nil
+	}
+
+	summary := data.Annotations["summary"]
+	if len(data.Annotations) == 0 {
+		summary = serv.describe(data)
+	}
+
+	format := "%[1]s: %[2]s"
+	if serv.statusPosition == "suffix" {
+		format = "%[2]s (%[1]s)"
+	}
+	overhead := messageLength(serv.withReceiver(data, fmt.Sprintf(format, data.Status, "")))
+	message := fmt.Sprintf(format, data.Status, truncate(summary, length-overhead))
+	return serv.withReceiver(data, message), nil
+}
+
+// Prefix message with the alert's receiver when configured
+func (serv *Server) withReceiver(data TemplateData, message string) string {
+	if serv.receiverInMsg {
+		message = fmt.Sprintf("[%s] %s", data.Receiver, message)
+	}
+	return message
+}
+
+// Surround message with MESSAGE_PREFIX and MESSAGE_SUFFIX, when set
+func (serv *Server) withDeployment(message string) string {
+	if serv.messagePrefix != "" {
+		message = serv.messagePrefix + " " + message
+	}
+	if serv.messageSuffix != "" {
+		message = message + " " + serv.messageSuffix
+	}
+	return message
+}
+
+// Describe an alert from its labels using the description template
+func (serv *Server) describe(data TemplateData) string {
+	var description bytes.Buffer
+	err := serv.descriptionTemplate.Execute(&description, data)
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot render description of alert %s: %s", data.Labels["alertname"], err.Error()))
+		return data.Labels["alertname"]
+	}
+	return description.String()
+}
+
+// Gather several messages into a single one under an optional header, as long as it fits in length
+func combineMessages(header string, messages []string, length int) string {
+	title := fmt.Sprintf("%d alerts", len(messages))
+	if header != "" {
+		// Leave most of the room to the alerts themselves
+		title = fmt.Sprintf("%s [%s]", title, truncate(header, length/4))
+	}
+	combined := fmt.Sprintf("%s:\n%s", title, strings.Join(messages, "\n"))
+	return truncate(combined, length)
+}
+
+// Surround message with the team's header and footer, shortening them to fit in length
+func withTeamText(message string, team Team, length int) string {
+	room := length - messageLength(message)
+	if team.Header != "" && room > 1 {
+		header := truncate(team.Header, room-1)
+		message = header + "\n" + message
+		room -= messageLength(header) + 1
+	}
+	if team.Footer != "" && room > 1 {
+		message = message + "\n" + truncate(team.Footer, room-1)
+	}
+	return message
+}
+
+// Shorten text to length characters at most as SMS count them, marking the cut with an ellipsis
+func truncate(text string, length int) string {
+	if messageLength(text) <= length {
+		return text
+	}
+	if length <= 0 {
+		return ""
+	}
+
+	// The ellipsis character would switch GSM-7 messages to UCS-2, halving their room
+	gsm := isGSM(text)
+	ellipsis := "…"
+	if gsm {
+		ellipsis = "..."
+	}
+	if length <= messageLength(ellipsis) {
+		return fittingPrefix(text, length, gsm)
+	}
+	return fittingPrefix(text, length-messageLength(ellipsis), gsm) + ellipsis
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	smsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "twilio_sms_sent_total",
+		Help: "SMS accepted by twilio.",
+	})
+	smsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twilio_sms_failed_total",
+		Help: "SMS that could not be sent, retries included, by reason: queue, auth, other or network.",
+	}, []string{"reason"})
+	callsPlaced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "twilio_calls_placed_total",
+		Help: "Voice calls accepted by twilio.",
+	})
+	callsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twilio_calls_failed_total",
+		Help: "Voice calls that could not be placed, retries included, by reason: queue, auth, other or network.",
+	}, []string{"reason"})
+	messageStatuses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twilio_message_status_total",
+		Help: "Delivery receipts received from twilio, by message status e.g. delivered, undelivered or failed.",
+	}, []string{"status"})
+	smsSuppressed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sms_suppressed_total",
+		Help: "Messages not sent on purpose, by reason: daily_cap, lookup, rate_limit or duplicate.",
+	}, []string{"reason"})
+	alertsSuppressed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "alerts_suppressed_total",
+		Help: "Alerts not sent because every recipient was suppressed by the daily cap, the rate limit or twilio Lookup.",
+	})
+	twilioDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "twilio_request_duration_seconds",
+		Help:    "Duration of requests sending SMS or placing calls through twilio.",
+		Buckets: prometheus.DefBuckets,
+	})
+	webhookRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_requests_total",
+		Help: "Webhook requests by HTTP status.",
+	}, []string{"status"})
+	sheetCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sheet_cache_lookups_total",
+		Help: "Team lookups by result: hit in the cache, miss read from the Sheet, fallback to the fallback cache, or unknown team recently missing from the Sheet.",
+	}, []string{"result"})
+	sheetFallbackServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sheet_fallback_served_total",
+		Help: "Team lookups answered from the fallback cache because the Sheet could not be read, their numbers being possibly stale.",
+	})
+	escalations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "alert_escalations_total",
+		Help: "Alerts sent to the escalation team because nobody from their team could be reached.",
+	})
+	overrideBroadcasts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emergency_override_broadcasts_total",
+		Help: "Alerts also sent to the broadcast team because of the emergency override.",
+	})
+	sentryEnabledGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sentry_enabled",
+		Help: "Whether errors are reported to Sentry, it is turned off after repeated send failures.",
+	})
+)
+
+// Get the failure reason of a send error for metrics
+func failureReason(err error) string {
+	switch e := err.(type) {
+	case *TwilioError:
+		return e.Kind()
+	case *url.Error:
+		return "network"
+	}
+	return "other"
+}
+
+// Records the status written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Count the requests handled by handler by status
+func countRequests(counter *prometheus.CounterVec, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+		counter.WithLabelValues(strconv.Itoa(recorder.status)).Inc()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// Severities also sent to the notification webhook, when one is set
+const defaultNotifyWebhookSeverities = "critical"
+
+// A backend messages are sent through, returns the backend's ID of the message when it gives one
+type Notifier interface {
+	Send(ctx context.Context, recipient string, message string) (string, error)
+}
+
+// Sends SMS or WhatsApp messages through twilio, retrying and failing over senders
+type twilioNotifier struct {
+	serv    *Server
+	channel string
+}
+
+func (notifier twilioNotifier) Send(ctx context.Context, recipient string, message string) (string, error) {
+	return notifier.serv.send(ctx, notifier.channel, recipient, message)
+}
+
+// Sends SMS through an email-to-SMS gateway
+type emailNotifier struct {
+	gateway  EmailGateway
+	settings ChannelSettings
+}
+
+func (notifier emailNotifier) Send(ctx context.Context, recipient string, message string) (string, error) {
+	return retrying(ctx, notifier.settings, "Sending SMS by email to", maskPhone(recipient), func() (string, error) {
+		return "", sendEmailSms(notifier.gateway, notifier.settings.Timeout, recipient, message)
+	})
+}
+
+// A non-2xx response from the notification webhook
+type WebhookError struct {
+	Status     string
+	StatusCode int
+	Body       string
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("Notification webhook answered %s: %s", e.Status, e.Body)
+}
+
+// Tell whether the webhook may accept the same message later
+func (e *WebhookError) Temporary() bool {
+	return retryStatuses[e.StatusCode]
+}
+
+// Posts messages to an incoming webhook taking Slack's format, recipients being the teams paged
+type webhookNotifier struct {
+	settings ChannelSettings
+	url      string
+}
+
+func (notifier webhookNotifier) Send(ctx context.Context, recipient string, message string) (string, error) {
+	log.Printf("Posting message for team %s to notification webhook: %s", recipient, message)
+	payload, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{fmt.Sprintf("[%s] %s", recipient, message)})
+	if err != nil {
+		return "", err
+	}
+
+	return retrying(ctx, notifier.settings, "Posting message for team", recipient, func() (string, error) {
+		return "", notifier.post(ctx, payload)
+	})
+}
+
+func (notifier webhookNotifier) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", notifier.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := notifier.settings.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &WebhookError{Status: resp.Status, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+// Get the notifier sending messages through a channel
+func (serv *Server) channelNotifier(channel string) Notifier {
+	if channel == "email" {
+		return emailNotifier{serv.email, serv.channelSettings("email")}
+	}
+	return twilioNotifier{serv, channel}
+}
+
+// Send the delivery's message through the notifiers configured on top of its channel, their failures being only logged
+func (serv *Server) notifyOthers(ctx context.Context, delivery Delivery) {
+	if !contains(serv.notifierSeverities, delivery.Severity) {
+		return
+	}
+	for _, notifier := range serv.notifiers {
+		if serv.dryRun {
+			log.Printf("DRY RUN - not posting message for team %s: %s", delivery.Team, delivery.Message)
+			continue
+		}
+		_, err := notifier.Send(ctx, delivery.Team, delivery.Message)
+		if err != nil {
+			logError(fmt.Sprintf("Cannot send message for team %s: %s", delivery.Team, err.Error()), err, delivery)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// How long the emergency override cell's value is kept before reading it again
+const overrideTTL = time.Minute
+
+// Cell values turning the emergency override on
+var overrideValues = map[string]bool{"yes": true, "y": true, "true": true, "1": true, "on": true, "x": true}
+
+// Tell whether the emergency override is on in the Sheet, keeping the last known state when it cannot be read
+func (serv *Server) overrideActive(ctx context.Context) bool {
+	if serv.overrideCell == "" || serv.broadcastTeam == "" {
+		return false
+	}
+
+	active, found := serv.overrideCache.Get("active")
+	if found {
+		return active.(bool)
+	}
+
+	value, err := serv.readOverride(ctx)
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot read emergency override cell %s, keeping last known state - %s", serv.overrideCell, err.Error()))
+		active, _ = serv.overrideCache.Get("last")
+		value, _ = active.(bool)
+	}
+	serv.overrideCache.Set("active", value, cache.DefaultExpiration)
+	serv.overrideCache.Set("last", value, cache.NoExpiration)
+	return value
+}
+
+func (serv *Server) readOverride(ctx context.Context) (bool, error) {
+	sheets, err := serv.sheetsService()
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Cannot create Sheets service - %s", err.Error()))
+	}
+
+	resp, err := sheets.Spreadsheets.Values.Get(serv.google.SpreadsheetId, serv.overrideCell).Context(ctx).Do()
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Cannot read Sheet - %s", err.Error()))
+	}
+	if len(resp.Values) == 0 {
+		return false, nil
+	}
+	return overrideValues[strings.ToLower(cell(resp.Values[0], 0))], nil
+}
+
+// Get the broadcast team's recipients when the emergency override is on, read from the alert's spreadsheet
+func (serv *Server) broadcastRecipients(ctx context.Context, spreadsheet Spreadsheet) []string {
+	if !serv.overrideActive(ctx) {
+		return nil
+	}
+
+	broadcast, err := serv.getTeamNumbers(ctx, spreadsheet, serv.broadcastTeam)
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot page broadcast team: %s", err.Error()))
+		return nil
+	}
+	return serv.formatRecipients(serv.broadcastTeam, broadcast.Numbers)
+}
+
+// Log and count an alert sent to the broadcast team too, once it is being sent rather than simulated
+func (serv *Server) announceBroadcast(delivery Delivery) {
+	if delivery.Broadcast == "" {
+		return
+	}
+	logMessage(fmt.Sprintf("EMERGENCY OVERRIDE is on, also paging broadcast team %s", delivery.Broadcast))
+	overrideBroadcasts.Inc()
+}
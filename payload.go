@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version of the Alertmanager webhook payload this service understands
+const payloadVersion = "4"
+
+// The top-level fields of an Alertmanager webhook payload, pointers telling missing fields apart
+type payloadShape struct {
+	Version  *string `json:"version"`
+	Receiver *string `json:"receiver"`
+	Alerts   *[]struct {
+		Status string `json:"status"`
+	} `json:"alerts"`
+}
+
+// Check that body looks like an Alertmanager webhook payload, rather than some other JSON
+func checkPayload(body []byte) error {
+	var payload payloadShape
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Not an Alertmanager payload: %s", err.Error()))
+	}
+	if payload.Version != nil && *payload.Version != payloadVersion {
+		return errors.New(fmt.Sprintf("Unsupported Alertmanager payload version \"%s\", expecting \"%s\"", *payload.Version, payloadVersion))
+	}
+	if payload.Receiver == nil {
+		return errors.New("Not an Alertmanager payload: missing \"receiver\"")
+	}
+	if payload.Alerts == nil {
+		return errors.New("Not an Alertmanager payload: missing \"alerts\"")
+	}
+	for i, alert := range *payload.Alerts {
+		if alert.Status != "firing" && alert.Status != "resolved" {
+			return errors.New(fmt.Sprintf("Not an Alertmanager payload: alert %d has status \"%s\", expecting \"firing\" or \"resolved\"", i, alert.Status))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Write the fallback cache to its file, so that it survives restarts
+func (serv *Server) saveLongCache() {
+	if serv.longCachePath == "" {
+		return
+	}
+
+	teams := make(map[string]Team)
+	for name, item := range serv.longCache.Items() {
+		teams[name] = item.Object.(Team)
+	}
+	content, err := json.Marshal(teams)
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot encode fallback cache: %s", err.Error()))
+		return
+	}
+
+	// Write next to the file then move it, a crash must not leave a truncated cache behind
+	temp, err := ioutil.TempFile(filepath.Dir(serv.longCachePath), filepath.Base(serv.longCachePath)+".*")
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot write fallback cache file: %s", err.Error()))
+		return
+	}
+	_, err = temp.Write(content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), serv.longCachePath)
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		logMessage(fmt.Sprintf("Cannot write fallback cache file: %s", err.Error()))
+	}
+}
+
+// Fill the fallback cache from its file, if it was saved before
+func (serv *Server) restoreLongCache() {
+	if serv.longCachePath == "" {
+		return
+	}
+
+	content, err := ioutil.ReadFile(serv.longCachePath)
+	if os.IsNotExist(err) {
+		log.Printf("No fallback cache file at %s yet", serv.longCachePath)
+		return
+	}
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot read fallback cache file: %s", err.Error()))
+		return
+	}
+
+	var teams map[string]Team
+	err = json.Unmarshal(content, &teams)
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot decode fallback cache file %s: %s", serv.longCachePath, err.Error()))
+		return
+	}
+	// Files saved before matching became case-insensitive, or with another setting, have keys normalized again
+	for name, team := range teams {
+		serv.longCache.Set(serv.teamKey(name), team, cache.DefaultExpiration)
+	}
+	log.Printf("Restored fallback cache of %d teams from %s", len(teams), serv.longCachePath)
+}
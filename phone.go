@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Parse a loosely formatted phone number and return it in E.164 format,
+// numbers without an international prefix are read as local to region
+func normalizePhone(number string, region string) (string, error) {
+	number = strings.TrimSpace(number)
+	if number == "" {
+		return "", errors.New("Empty phone number")
+	}
+
+	// Digits only may be a number written with its country code but no +, the format used without a region
+	if digits := strings.Join(strings.Fields(number), ""); strings.Trim(digits, "0123456789") == "" {
+		if parsed, err := phonenumbers.Parse("+"+digits, ""); err == nil && phonenumbers.IsValidNumber(parsed) {
+			return phonenumbers.Format(parsed, phonenumbers.E164), nil
+		}
+	}
+
+	parsed, err := phonenumbers.Parse(number, region)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Cannot parse phone number %s: %s", number, err.Error()))
+	}
+	if !phonenumbers.IsValidNumber(parsed) {
+		return "", errors.New(fmt.Sprintf("Invalid phone number %s for region %s", number, region))
+	}
+	return phonenumbers.Format(parsed, phonenumbers.E164), nil
+}
+
+// Turn a phone number written with its country code into E.164, with exactly one leading + whatever the number starts with
+func formatPhone(number string) (string, error) {
+	formatted := "+" + strings.TrimLeft(strings.Join(strings.Fields(number), ""), "+")
+	if !regexpPhone.MatchString(formatted) {
+		return "", errors.New(fmt.Sprintf("Invalid phone number %s, expecting digits starting with the country code", number))
+	}
+	return formatted, nil
+}
+
+// Get the country calling code of an E.164 phone number, 0 when unknown
+func countryCode(number string) int {
+	parsed, err := phonenumbers.Parse(number, "")
+	if err != nil {
+		return 0
+	}
+	return int(parsed.GetCountryCode())
+}
+
+// Parse an already validated comma-separated list of country calling codes
+func parseCountryCodes(value string) map[int]bool {
+	codes := make(map[int]bool)
+	if value == "" {
+		return codes
+	}
+	for _, code := range strings.Split(value, ",") {
+		parsed, _ := strconv.Atoi(code)
+		codes[parsed] = true
+	}
+	return codes
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		number string
+		region string
+		want   string
+	}{
+		{"+33611111111", "FR", "+33611111111"},
+		{"+33 6 11 11 11 11", "FR", "+33611111111"},
+		{"06 11 11 11 11", "FR", "+33611111111"},
+		{"0611111111", "FR", "+33611111111"},
+		// Country code without a +, as documented for deployments without a region
+		{"33611111111", "FR", "+33611111111"},
+		{"14155552671", "FR", "+14155552671"},
+		{"+14155552671", "FR", "+14155552671"},
+		{"14155552671", "US", "+14155552671"},
+		{"4155552671", "US", "+14155552671"},
+	}
+	for _, test := range tests {
+		got, err := normalizePhone(test.number, test.region)
+		if err != nil {
+			t.Errorf("normalizePhone(%q, %q) failed: %s", test.number, test.region, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("normalizePhone(%q, %q) = %q, want %q", test.number, test.region, got, test.want)
+		}
+	}
+}
+
+func TestNormalizePhoneInvalid(t *testing.T) {
+	for _, number := range []string{"", "  ", "n/a", "+0611111111", "123"} {
+		if got, err := normalizePhone(number, "FR"); err == nil {
+			t.Errorf("normalizePhone(%q, \"FR\") = %q, want an error", number, got)
+		}
+	}
+}
+
+func TestFormatPhone(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"33611111111", "+33611111111"},
+		{"+33611111111", "+33611111111"},
+		{"33 6 11 11 11 11", "+33611111111"},
+		{"++33611111111", "+33611111111"},
+	}
+	for _, test := range tests {
+		got, err := formatPhone(test.number)
+		if err != nil {
+			t.Errorf("formatPhone(%q) failed: %s", test.number, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("formatPhone(%q) = %q, want %q", test.number, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Channels an alert can be sent through, "none" dropping it
+var policyChannels = map[string]bool{"sms": true, "whatsapp": true, "email": true, "call": true, "none": true}
+
+// How alerts of a severity are sent, and which Sheet columns their recipients are read from
+type SeverityPolicy struct {
+	Channel string   `json:"channel"`
+	Columns []string `json:"columns"`
+}
+
+// Parse the per-severity policies, column letters being turned into indexes
+func parseSeverityPolicies(value string) map[string]SeverityPolicy {
+	policies := make(map[string]SeverityPolicy)
+	if value != "" {
+		_ = json.Unmarshal([]byte(value), &policies)
+	}
+	return policies
+}
+
+// Tell whether a per-severity policy is usable, an email gateway being needed to send emails and voice calls to call
+func validSeverityPolicies(value string, emailGateway string, voiceEnabled bool) bool {
+	var policies map[string]SeverityPolicy
+	if json.Unmarshal([]byte(value), &policies) != nil {
+		return false
+	}
+	for _, policy := range policies {
+		if !policyChannels[policy.Channel] || (policy.Channel == "email" && emailGateway == "") || (policy.Channel == "call" && !voiceEnabled) {
+			return false
+		}
+		for _, column := range policy.Columns {
+			if !regexpColumn.MatchString(column) || column == "A" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Get the policy applying to an alert's severity, if any
+func (serv *Server) severityPolicy(severity string) (SeverityPolicy, bool) {
+	policy, found := serv.severityPolicies[severity]
+	if found {
+		log.Printf("Applying policy of severity \"%s\": channel %s, columns %v", severity, policy.Channel, policy.Columns)
+	}
+	return policy, found
+}
+
+// Get the highest column index used by the policies, -1 when none
+func (serv *Server) lastPolicyColumn() int {
+	last := -1
+	for _, policy := range serv.severityPolicies {
+		for _, column := range policy.Columns {
+			if index := columnIndex(column); index > last {
+				last = index
+			}
+		}
+	}
+	return last
+}
+
+// Get the team's phone numbers read from the given columns
+func (team Team) numbersIn(columns []string) []interface{} {
+	var numbers []interface{}
+	for _, column := range columns {
+		if number, found := team.Columns[columnIndex(column)]; found {
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers
+}
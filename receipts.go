@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Header holding twilio's signature of its requests
+const twilioSignatureHeader = "X-Twilio-Signature"
+
+// How long the messages sent are remembered, for their delivery receipts to be traced back to alerts
+const receiptsTTL = 24 * time.Hour
+
+// Tell whether signature is twilio's signature of a request to callbackUrl with params,
+// the base64 HMAC-SHA1 of the URL followed by the sorted parameters, keyed with the account's auth token
+func validTwilioSignature(authToken string, callbackUrl string, params url.Values, signature string) bool {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var data strings.Builder
+	data.WriteString(callbackUrl)
+	for _, key := range keys {
+		for _, value := range params[key] {
+			data.WriteString(key)
+			data.WriteString(value)
+		}
+	}
+	expected := hmac.New(sha1.New, []byte(authToken))
+	expected.Write([]byte(data.String()))
+	given, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil && hmac.Equal(given, expected.Sum(nil))
+}
+
+// Remember which alert and recipient the messages of sids were sent for, when delivery receipts are expected
+func (serv *Server) rememberMessages(sids string, delivery Delivery, recipient string) {
+	if serv.twilio.StatusCallback == "" || sids == "" {
+		return
+	}
+	for _, sid := range strings.Split(sids, ",") {
+		serv.receipts.SetDefault(sid, AuditRecord{
+			Alert:       delivery.Alert,
+			Fingerprint: delivery.Fingerprint,
+			Team:        delivery.Team,
+			Channel:     delivery.Channel,
+			Recipient:   maskPhone(recipient),
+			MessageSid:  sid,
+			Code:        delivery.Code,
+		})
+	}
+}
+
+// Receive twilio's delivery receipts, telling whether the messages sent reached their recipients' phones
+func (serv *Server) messageStatus(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		asJson(w, http.StatusMethodNotAllowed, "unsupported HTTP method")
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		asJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validTwilioSignature(serv.twilioSigningToken, serv.twilio.StatusCallback, r.PostForm, r.Header.Get(twilioSignatureHeader)) {
+		log.Printf("Rejecting delivery receipt from %s with invalid twilio signature", r.RemoteAddr)
+		asJson(w, http.StatusForbidden, "invalid signature")
+		return
+	}
+
+	sid := r.PostForm.Get("MessageSid")
+	status := r.PostForm.Get("MessageStatus")
+	messageStatuses.WithLabelValues(status).Inc()
+
+	// Messages sent before a restart are not remembered
+	record := AuditRecord{MessageSid: sid, Recipient: maskPhone(strings.TrimPrefix(r.PostForm.Get("To"), "whatsapp:"))}
+	if remembered, found := serv.receipts.Get(sid); found {
+		record = remembered.(AuditRecord)
+	}
+	message := "Message " + sid
+	if record.Alert != "" {
+		message += " of alert " + record.Alert
+	}
+	record.Time = time.Now().UTC()
+	record.Status = status
+	if errorCode := r.PostForm.Get("ErrorCode"); errorCode != "" {
+		record.Error = fmt.Sprintf("Twilio error %s", errorCode)
+	}
+
+	switch status {
+	case "delivered":
+		log.Printf("%s delivered to %s", message, record.Recipient)
+		serv.audit.write(record)
+	case "undelivered", "failed":
+		reason := status
+		if record.Error != "" {
+			reason += " - " + record.Error
+		}
+		logMessage(fmt.Sprintf("%s could not be delivered to %s: %s", message, record.Recipient, reason))
+		serv.audit.write(record)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
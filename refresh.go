@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Outcome of a Sheet refresh
+type RefreshResult struct {
+	Teams int `json:"teams"`
+}
+
+// Forget the teams read from the Sheet and read them again, for changes to take effect right away
+func (serv *Server) refresh(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		asJson(w, http.StatusMethodNotAllowed, "unsupported HTTP method")
+		return
+	}
+
+	if _, ok := serv.readManagementBody(w, r); !ok {
+		return
+	}
+
+	log.Printf("Refreshing teams from Sheet")
+	serv.shortCache.Flush()
+	serv.unknownTeams.Flush()
+	total := 0
+	for _, spreadsheet := range serv.spreadsheets {
+		teams, err := serv.readSpreadsheet(r.Context(), spreadsheet)
+		if err != nil {
+			logMessage(fmt.Sprintf("Cannot refresh teams: %s", err.Error()))
+			asJson(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		total += teams
+	}
+	log.Printf("Refreshed %d teams from Sheet", total)
+	asJson(w, http.StatusOK, RefreshResult{Teams: total})
+}
+
+// Read a spreadsheet into the caches, sharing the read with the lookups of alerts coming in meanwhile.
+// The shared read goes on until the service stops, callers giving up on it when their ctx is done
+func (serv *Server) readSpreadsheet(ctx context.Context, spreadsheet Spreadsheet) (int, error) {
+	read := serv.sheetReads.DoChan(spreadsheet.Id, func() (interface{}, error) {
+		return serv.readSheetWithRetries(serv.ctx, spreadsheet)
+	})
+	select {
+	case result := <-read:
+		if result.Err != nil {
+			return 0, result.Err
+		}
+		return result.Val.(int), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Read the Sheet into the caches every interval, from startup on, so that webhook requests find them warm,
+// until the service starts shutting down
+func (serv *Server) refreshPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, spreadsheet := range serv.spreadsheets {
+			teams, err := serv.readSpreadsheet(serv.ctx, spreadsheet)
+			// The teams read last time stay in the fallback cache
+			if err != nil {
+				logMessage(fmt.Sprintf("Cannot refresh teams in the background, keeping the last ones read: %s", err.Error()))
+				continue
+			}
+			log.Printf("Refreshed %d teams from Sheet in the background", teams)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-serv.stopping:
+			return
+		case <-serv.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/alertmanager/template"
+)
+
+// An alert along with where it was routed to, and why it could not be sent, or only to some recipients
+type AlertOutcome struct {
+	Alert       string   `json:"alert"`
+	Fingerprint string   `json:"fingerprint"`
+	Team        string   `json:"team,omitempty"`
+	Recipients  []string `json:"recipients,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// What became of a notification's alerts, alerts held, dropped or suppressed on purpose being skipped
+type Report struct {
+	Sent    []AlertOutcome `json:"sent"`
+	Failed  []AlertOutcome `json:"failed"`
+	Skipped []AlertOutcome `json:"skipped"`
+	// Recipients not sent an alert again, having been sent the very same message within the dedup window
+	Deduplicated int `json:"deduplicated"`
+}
+
+func newReport() Report {
+	return Report{Sent: []AlertOutcome{}, Failed: []AlertOutcome{}, Skipped: []AlertOutcome{}}
+}
+
+func newAlertOutcome(alert template.Alert, delivery Delivery, err error) AlertOutcome {
+	outcome := AlertOutcome{Alert: alert.Labels["alertname"], Fingerprint: alertKey(alert), Team: delivery.Team}
+	// Reports may end up in Alertmanager's logs, phone numbers are masked like in the audit trail
+	for _, recipient := range delivery.Recipients {
+		outcome.Recipients = append(outcome.Recipients, maskPhone(recipient))
+	}
+	for _, recipient := range delivery.CC {
+		outcome.Recipients = append(outcome.Recipients, maskPhone(recipient))
+	}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	return outcome
+}
+
+// Record the outcome of processing an alert, alerts that reached someone count as sent despite errors
+// and alerts only suppressed on purpose, e.g. by the daily cap of their escalation team, as skipped
+func (report *Report) add(alert template.Alert, delivery Delivery, reached bool, err error) {
+	outcome := newAlertOutcome(alert, delivery, err)
+	if err == errSuppressed && !reached {
+		report.Skipped = append(report.Skipped, outcome)
+		return
+	}
+	if err != nil && !reached {
+		report.Failed = append(report.Failed, outcome)
+		return
+	}
+	report.Sent = append(report.Sent, outcome)
+}
+
+// Record an alert not sent on purpose, along with the reason why
+func (report *Report) skip(alert template.Alert, delivery Delivery, reason error) {
+	report.Skipped = append(report.Skipped, newAlertOutcome(alert, delivery, reason))
+}
+
+func (report *Report) merge(other Report) {
+	report.Sent = append(report.Sent, other.Sent...)
+	report.Failed = append(report.Failed, other.Failed...)
+	report.Skipped = append(report.Skipped, other.Skipped...)
+	report.Deduplicated += other.Deduplicated
+}
+
+// Tell whether not a single alert could be sent, a partial failure is not worth a retry sending everything again
+func (report Report) allFailed() bool {
+	return len(report.Sent) == 0 && len(report.Failed) > 0
+}
+
+// Log every failure of the report
+func (report Report) logFailures(context string) {
+	for _, failure := range report.Failed {
+		logMessage(fmt.Sprintf("%s: cannot send alert %s: %s", context, failure.Alert, failure.Error))
+	}
+}
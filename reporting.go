@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/alertmanager/template"
+)
+
+// Whether errors are reported to Sentry, read and written from concurrent requests
+var sentryEnabled int32
+
+func usingSentry() bool {
+	return atomic.LoadInt32(&sentryEnabled) == 1
+}
+
+func setUsingSentry(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&sentryEnabled, value)
+	sentryEnabledGauge.Set(float64(value))
+}
+
+// Tell whether a Sentry DSN is well-formed, Sentry itself may still reject it
+func validSentryDsn(dsn string) bool {
+	_, err := sentry.NewDsn(dsn)
+	return err == nil
+}
+
+// Sends Sentry events, turning error reporting off after maxFailures sends in a row failed
+type sentryTransport struct {
+	next        http.RoundTripper
+	maxFailures int
+
+	mu       sync.Mutex
+	failures int
+}
+
+func (transport *sentryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.next.RoundTrip(req)
+
+	// Being rate limited is not a sign of a bad DSN
+	failed := err != nil || (resp.StatusCode >= 400 && resp.StatusCode != http.StatusTooManyRequests)
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if !failed {
+		transport.failures = 0
+		return resp, err
+	}
+
+	transport.failures++
+	if transport.failures == transport.maxFailures && usingSentry() {
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+		}
+		setUsingSentry(false)
+		log.Printf("Disabling Sentry after %d failed sends in a row, check SENTRY_DSN (%s)", transport.failures, reason)
+	}
+	return resp, err
+}
+
+// Set Sentry up, returns an error when the client cannot be created
+func initSentry(dsn string, maxFailures int, tracesSampleRate float64) error {
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              dsn,
+		HTTPTransport:    &sentryTransport{next: http.DefaultTransport, maxFailures: maxFailures},
+		TracesSampleRate: tracesSampleRate,
+	})
+	if err != nil {
+		return err
+	}
+	setUsingSentry(true)
+	return nil
+}
+
+// Tag Sentry events with what they are about, for them to be searched and grouped by team or severity
+func setAlertTags(scope *sentry.Scope, alertname string, status string, team string, severity string) {
+	for tag, value := range map[string]string{"alertname": alertname, "status": status, "team": team, "severity": severity} {
+		if value != "" {
+			scope.SetTag(tag, value)
+		}
+	}
+}
+
+// Log message about an alert and report it to Sentry tagged with the alert's details
+func (serv *Server) logAlertMessage(alert template.Alert, message string) {
+	log.Println(message)
+	if !usingSentry() {
+		return
+	}
+
+	sentry.WithScope(func(scope *sentry.Scope) {
+		setAlertTags(scope, alert.Labels["alertname"], alert.Status, serv.alertTeam(alert), alert.Labels["severity"])
+		sentry.CaptureMessage(message)
+	})
+}
+
+// Log message about a delivery and report it to Sentry along with the details of err, grouping twilio errors by their code
+func logError(message string, err error, delivery Delivery) {
+	log.Println(message)
+	if !usingSentry() {
+		return
+	}
+
+	sentry.WithScope(func(scope *sentry.Scope) {
+		setAlertTags(scope, delivery.Alert, delivery.Status, delivery.Team, delivery.Severity)
+		if twilioErr, ok := err.(*TwilioError); ok {
+			code := strconv.Itoa(twilioErr.Code)
+			scope.SetTag("twilio_code", code)
+			scope.SetTag("twilio_kind", twilioErr.Kind())
+			scope.SetTag("twilio_status", strconv.Itoa(twilioErr.StatusCode))
+			scope.SetExtra("twilio_message", twilioErr.Message)
+			scope.SetExtra("twilio_more_info", twilioErr.MoreInfo)
+			scope.SetFingerprint([]string{"twilio", code})
+		}
+		sentry.CaptureMessage(message)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header names of the columns holding the on-call numbers of a time window e.g. "08:00-16:00"
+var regexpWindow = regexp.MustCompile("^([01]?[0-9]|2[0-3]):([0-5][0-9])-([01]?[0-9]|2[0-4]):([0-5][0-9])$")
+
+// A time of day window, in minutes since midnight, ending the next day when End is before Start
+type Window struct {
+	Start int
+	End   int
+}
+
+func parseWindow(name string) (Window, bool) {
+	match := regexpWindow.FindStringSubmatch(strings.ReplaceAll(name, " ", ""))
+	if match == nil {
+		return Window{}, false
+	}
+	minutes := func(hours string, minutes string) int {
+		h, _ := strconv.Atoi(hours)
+		m, _ := strconv.Atoi(minutes)
+		return h*60 + m
+	}
+	window := Window{Start: minutes(match[1], match[2]), End: minutes(match[3], match[4])}
+	return window, window.End <= 24*60
+}
+
+func (window Window) contains(minute int) bool {
+	if window.Start <= window.End {
+		return window.Start <= minute && minute < window.End
+	}
+	return minute >= window.Start || minute < window.End
+}
+
+// Find the columns named after time windows in the header row, nil unless schedules are enabled
+func (serv *Server) scheduleWindows(header map[int]string) map[int]string {
+	if serv.scheduleLocation == nil {
+		return nil
+	}
+
+	windows := make(map[int]string)
+	for column, name := range header {
+		if _, ok := parseWindow(name); ok {
+			windows[column] = name
+		}
+	}
+	return windows
+}
+
+// Get the team with the numbers of its time windows active right now, its other numbers being used when none is
+func (serv *Server) onCall(name string, team Team) Team {
+	if len(team.Schedule) == 0 || serv.scheduleLocation == nil {
+		return team
+	}
+
+	now := time.Now().In(serv.scheduleLocation)
+	minute := now.Hour()*60 + now.Minute()
+	windows := make([]string, 0, len(team.Schedule))
+	for window := range team.Schedule {
+		windows = append(windows, window)
+	}
+	sort.Strings(windows)
+
+	var active []string
+	var numbers []interface{}
+	for _, window := range windows {
+		if parsed, _ := parseWindow(window); parsed.contains(minute) {
+			active = append(active, window)
+			numbers = append(numbers, team.Schedule[window]...)
+		}
+	}
+	if len(numbers) == 0 {
+		log.Printf("No time window of team %s is on call at %s, sending to its other numbers", name, now.Format("15:04 MST"))
+		return team
+	}
+	log.Printf("Sending to the %s on-call of team %s", strings.Join(active, ", "), name)
+	team.Numbers = numbers
+	return team
+}
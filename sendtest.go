@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Sent when a test message has no text of its own
+const defaultTestMessage = "Test message from alertmanager-twilio-gsheets"
+
+// A SMS sent on request to check that twilio can be reached with our credentials
+type TestMessage struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+type TestResult struct {
+	Sid    string `json:"sid,omitempty"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+// Send a SMS to the given number the way alerts are sent, answering twilio's ID of the message
+func (serv *Server) sendTest(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		asJson(w, http.StatusMethodNotAllowed, "unsupported HTTP method")
+		return
+	}
+
+	body, ok := serv.readManagementBody(w, r)
+	if !ok {
+		return
+	}
+
+	var test TestMessage
+	err := json.Unmarshal(body, &test)
+	if err != nil {
+		asJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := serv.formatNumber(strings.TrimSpace(test.To))
+	if err != nil {
+		asJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !serv.testRecipientAllowed(r.Context(), to) {
+		log.Printf("Rejecting test SMS to %s, neither an allowed number nor a recipient of a team", maskPhone(to))
+		asJson(w, http.StatusForbidden, "not an allowed test number nor a recipient of a team")
+		return
+	}
+	if test.Message == "" {
+		test.Message = defaultTestMessage
+	}
+	message := serv.withDeployment(test.Message)
+
+	if serv.dryRun {
+		log.Printf("DRY RUN - not sending test SMS to %s: %s", maskPhone(to), message)
+		asJson(w, http.StatusOK, TestResult{DryRun: true})
+		return
+	}
+	log.Printf("Sending test SMS to %s", maskPhone(to))
+	sid, err := serv.send(r.Context(), "sms", to, message)
+	if err != nil {
+		logMessage(fmt.Sprintf("Cannot send test SMS to %s: %s", maskPhone(to), err.Error()))
+		asJson(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	asJson(w, http.StatusOK, TestResult{Sid: sid})
+}
+
+// Tell whether test messages may be sent to number, one of TEST_ALLOWED_NUMBERS when set or else a recipient of a team of the Sheet
+func (serv *Server) testRecipientAllowed(ctx context.Context, number string) bool {
+	if len(serv.testNumbers) > 0 {
+		return contains(serv.testNumbers, number)
+	}
+	if serv.knownRecipient(number) {
+		return true
+	}
+
+	// The number may be one of teams not read yet
+	for _, spreadsheet := range serv.spreadsheets {
+		if _, err := serv.readSpreadsheet(ctx, spreadsheet); err != nil {
+			logMessage(fmt.Sprintf("Cannot read teams to check test recipient: %s", err.Error()))
+		}
+	}
+	return serv.knownRecipient(number)
+}
+
+// Tell whether number is a recipient of one of the teams in the caches
+func (serv *Server) knownRecipient(number string) bool {
+	for _, listing := range serv.knownTeams(false) {
+		if contains(listing.Recipients, number) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Teams are read from the range's first column, their phone numbers from the following ones
+const defaultSheetRange = "A2:D"
+
+// The part of the Sheet teams are read from, as column indexes and row numbers
+type SheetRange struct {
+	FirstColumn int
+	FirstRow    string
+	LastColumn  int
+	LastRow     string
+}
+
+// Parse an already validated A1 notation range e.g. "A2:D" or "B3:F100"
+func parseSheetRange(value string) SheetRange {
+	if value == "" {
+		value = defaultSheetRange
+	}
+	match := regexpSheetRange.FindStringSubmatch(value)
+	return SheetRange{
+		FirstColumn: columnIndex(match[1]),
+		FirstRow:    match[2],
+		LastColumn:  columnIndex(match[3]),
+		LastRow:     match[4],
+	}
+}
+
+// Tell whether a range is usable, its first column holding teams and the next ones phone numbers
+func validSheetRange(value string) bool {
+	match := regexpSheetRange.FindStringSubmatch(value)
+	return match != nil && columnIndex(match[1]) < columnIndex(match[3])
+}
+
+// A failed Sheet read, temporary ones being worth trying again
+type SheetError struct {
+	Message   string
+	Temporary bool
+}
+
+func (err *SheetError) Error() string {
+	return err.Message
+}
+
+// Wrap an error of the Sheets API, rate limits, server errors and network errors being temporary
+func newSheetError(err error) *SheetError {
+	temporary := true
+	if gerr, ok := err.(*googleapi.Error); ok {
+		temporary = gerr.Code == http.StatusTooManyRequests || gerr.Code >= http.StatusInternalServerError
+	}
+	return &SheetError{Message: fmt.Sprintf("Cannot read Sheet - %s", err.Error()), Temporary: temporary}
+}
+
+// Tell whether a Sheet read may succeed when tried again, an empty Sheet possibly being edited
+func retryableSheetError(err error) bool {
+	if err == errEmptySheet {
+		return true
+	}
+	sheetErr, ok := err.(*SheetError)
+	return ok && sheetErr.Temporary
+}
+
+// A team's row from the Sheet
+type Team struct {
+	Numbers []interface{} `json:"numbers"`
+	Header  string        `json:"header,omitempty"`
+	Footer  string        `json:"footer,omitempty"`
+	// Message template replacing the global one for the team's alerts
+	Template string `json:"template,omitempty"`
+	// Longest message the team's phones accept, 0 for twilio's limit
+	MaxLength int `json:"max_length,omitempty"`
+	// Phone numbers by column index, including the columns only used by severity policies
+	Columns map[int]interface{} `json:"columns,omitempty"`
+	// Phone numbers by escalation tier, as named by the header row
+	Tiers map[string][]interface{} `json:"tiers,omitempty"`
+	// Phone numbers by time window, as named by the header row, replacing Numbers while the window lasts
+	Schedule map[string][]interface{} `json:"schedule,omitempty"`
+	// When the row was read from the Sheet, zero for fallback caches saved before it was recorded
+	ReadAt time.Time `json:"read_at"`
+}
+
+// Cell values disabling a row when found in the active column
+var inactiveValues = map[string]bool{"no": true, "n": true, "false": true, "0": true, "off": true, "inactive": true}
+
+// Get the zero-based index of a column from its letters e.g. "A" is 0 and "AA" is 26
+func columnIndex(column string) int {
+	index := 0
+	for _, letter := range strings.ToUpper(column) {
+		index = index*26 + int(letter-'A') + 1
+	}
+	return index - 1
+}
+
+// Get the index of an optional column, -1 when unset
+func optionalColumn(column string) int {
+	if column == "" {
+		return -1
+	}
+	return columnIndex(column)
+}
+
+// Get the letters of a column from its zero-based index
+func columnName(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
+	}
+	return name
+}
+
+// Get the index of the last column phone numbers may be read from
+func (serv *Server) lastNumberColumn() int {
+	last := serv.sheetRange.LastColumn
+	if policyLast := serv.lastPolicyColumn(); policyLast > last {
+		last = policyLast
+	}
+	return last
+}
+
+// Get the A1 notation range to read, wide enough for the phone numbers and every special column
+func (serv *Server) readRange() string {
+	return serv.rowsRange(serv.sheetRange.FirstRow, serv.sheetRange.LastRow)
+}
+
+// Get the A1 notation range of the header row naming the columns
+func (serv *Server) headerRange() string {
+	row := strconv.Itoa(serv.headerRow)
+	return serv.rowsRange(row, row)
+}
+
+// Get the A1 notation range of the given rows, for the phone numbers and every special column
+func (serv *Server) rowsRange(firstRow string, lastRow string) string {
+	last := serv.lastNumberColumn()
+	for _, column := range serv.specialColumns() {
+		if column > last {
+			last = column
+		}
+	}
+	cells := fmt.Sprintf("%s%s:%s%s", columnName(serv.sheetRange.FirstColumn), firstRow, columnName(last), lastRow)
+	if serv.sheetName == "" {
+		return cells
+	}
+	return quoteSheetName(serv.sheetName) + "!" + cells
+}
+
+// Quote a sheet name for A1 notation, quotes in the name being doubled
+func quoteSheetName(name string) string {
+	return "'" + strings.ReplaceAll(name, "'", "''") + "'"
+}
+
+// Get the indexes of the configured columns holding something else than phone numbers
+func (serv *Server) specialColumns() []int {
+	var columns []int
+	for _, column := range []int{serv.activeColumn, serv.headerColumn, serv.footerColumn, serv.maxLengthColumn, serv.templateColumn} {
+		if column >= 0 {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// Get the value of a row's cell, rows are as long as their last non-empty cell
+func cell(row []interface{}, index int) string {
+	if index < 0 || index >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprint(row[index]))
+}
+
+// Get the value of a row's cell in column, rows starting at the range's first column
+func (serv *Server) rowCell(row []interface{}, column int) string {
+	if column < serv.sheetRange.FirstColumn {
+		return ""
+	}
+	return cell(row, column-serv.sheetRange.FirstColumn)
+}
+
+// Tell whether a row is enabled, rows without an active column always are
+func (serv *Server) rowActive(row []interface{}) bool {
+	if serv.activeColumn < 0 {
+		return true
+	}
+	return !inactiveValues[strings.ToLower(serv.rowCell(row, serv.activeColumn))]
+}
+
+// Get the team described by a row, phone numbers being read from the named phone number columns or else the non-special columns
+func (serv *Server) rowTeam(name string, row []interface{}, columns *namedColumns, windows map[int]string) Team {
+	team := Team{
+		Header:  serv.rowCell(row, serv.headerColumn),
+		Footer:  serv.rowCell(row, serv.footerColumn),
+		Columns: make(map[int]interface{}),
+	}
+	if value := serv.rowCell(row, serv.maxLengthColumn); value != "" {
+		maxLength, err := strconv.Atoi(value)
+		if err != nil || maxLength < minMessageLength {
+			log.Printf("Ignoring invalid maximum message length \"%s\" of team \"%s\"", value, name)
+		} else {
+			team.MaxLength = maxLength
+		}
+	}
+	if value := serv.rowCell(row, serv.templateColumn); value != "" {
+		if _, err := texttemplate.New("team").Parse(value); err != nil {
+			logMessage(fmt.Sprintf("Ignoring invalid message template of team \"%s\": %s", name, err.Error()))
+		} else {
+			team.Template = value
+		}
+	}
+
+	// The team's column is special too, the range's first one unless columns are named
+	special := map[int]bool{serv.sheetRange.FirstColumn: true}
+	if columns != nil {
+		special = map[int]bool{columns.team: true}
+		team.Numbers = serv.namedNumbers(row, columns)
+	}
+	for _, column := range serv.specialColumns() {
+		special[column] = true
+	}
+	first := serv.sheetRange.FirstColumn
+	for i := 0; i < len(row) && first+i <= serv.lastNumberColumn(); i++ {
+		column := first + i
+		if special[column] {
+			continue
+		}
+		// Numbers of time windows are only used while they last
+		if window, found := windows[column]; found {
+			if cell(row, i) != "" {
+				if team.Schedule == nil {
+					team.Schedule = make(map[string][]interface{})
+				}
+				team.Schedule[window] = append(team.Schedule[window], row[i])
+			}
+		} else if column <= serv.sheetRange.LastColumn && columns == nil {
+			team.Numbers = append(team.Numbers, row[i])
+		}
+		if cell(row, i) != "" {
+			team.Columns[column] = row[i]
+		}
+	}
+	return team
+}
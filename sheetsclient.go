@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Delays between attempts at creating the Sheets client, doubling from the first up to the last
+const (
+	minSheetsClientDelay = time.Second
+	maxSheetsClientDelay = 5 * time.Minute
+)
+
+// A Sheets client created once and reused, created again in the background while it fails
+type SheetsClient struct {
+	mu           sync.Mutex
+	service      *sheets.Service
+	reconnecting bool
+	lastErr      error
+}
+
+// Get the Sheets client, failing right away with the last error while it is being created again in the background
+func (serv *Server) sheetsService() (*sheets.Service, error) {
+	client := serv.sheetsClient
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.service != nil {
+		return client.service, nil
+	}
+	if client.reconnecting {
+		return nil, errors.New(fmt.Sprintf("%s (retrying in the background)", client.lastErr.Error()))
+	}
+
+	service, err := NewSpreadsheetService(serv.google)
+	if err != nil {
+		client.lastErr = err
+		client.reconnecting = true
+		go serv.reconnectSheets(err)
+		return nil, err
+	}
+	client.service = service
+	return service, nil
+}
+
+// Try creating the Sheets client again with an exponential backoff until it succeeds
+func (serv *Server) reconnectSheets(err error) {
+	client := serv.sheetsClient
+	for delay := minSheetsClientDelay; ; delay *= 2 {
+		if delay > maxSheetsClientDelay {
+			delay = maxSheetsClientDelay
+		}
+		message := fmt.Sprintf("Cannot create Sheets client, trying again in %s - %s", delay, err.Error())
+		// Only report the first failure to Sentry, the next ones are the same outage
+		if delay == minSheetsClientDelay {
+			logMessage(message)
+		} else {
+			log.Println(message)
+		}
+		time.Sleep(delay)
+
+		var service *sheets.Service
+		service, err = NewSpreadsheetService(serv.google)
+		client.mu.Lock()
+		if err == nil {
+			client.service = service
+			client.lastErr = nil
+			client.reconnecting = false
+			client.mu.Unlock()
+			log.Println("Sheets client created")
+			return
+		}
+		client.lastErr = err
+		client.mu.Unlock()
+	}
+}
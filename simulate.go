@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/alertmanager/template"
+)
+
+// A simulated alert delivery, along with the reason why it would fail
+type Simulation struct {
+	Delivery
+	Error string `json:"error,omitempty"`
+}
+
+// Go through the webhook's routing for an Alertmanager payload and return what would be sent, without sending anything
+func (serv *Server) simulate(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		asJson(w, http.StatusMethodNotAllowed, "unsupported HTTP method")
+		return
+	}
+
+	body, ok := serv.readAuthenticatedBody(w, r)
+	if !ok {
+		return
+	}
+
+	var alerts template.Data
+	err := json.Unmarshal(body, &alerts)
+	if err != nil {
+		logMessage(fmt.Sprintf("Error parsing alerts content: %s", err.Error()))
+		asJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = checkPayload(body)
+	if err != nil {
+		logMessage(err.Error())
+		asJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	simulations := make([]Simulation, 0, len(alerts.Alerts))
+	for _, alert := range alerts.Alerts {
+		if !serv.notifyOnResolved && alert.Status == "resolved" {
+			skipped := Delivery{
+				Alert:       alert.Labels["alertname"],
+				Fingerprint: alertKey(alert),
+				Status:      alert.Status,
+				Channel:     "none",
+			}
+			simulations = append(simulations, Simulation{Delivery: skipped, Error: errResolvedSkipped.Error()})
+			continue
+		}
+		delivery, err := serv.planDelivery(r.Context(), alert, alerts.Receiver)
+		simulation := Simulation{Delivery: delivery}
+		if err != nil {
+			simulation.Error = err.Error()
+		}
+		simulations = append(simulations, simulation)
+	}
+	asJson(w, http.StatusOK, simulations)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Characters of the GSM 03.38 basic set, SMS made of them only are sent in the compact GSM-7 encoding
+const gsmBasic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+// Characters of the GSM 03.38 extension table, taking two characters each
+const gsmExtended = "^{}\\[~]|€\f"
+
+// Shortest message length allowed, anything shorter cannot hold an alert
+const minMessageLength = 20
+
+// Most parts a message is split into, longer messages are cut
+const maxSplitParts = 10
+
+// Room taken by the numbering of split messages e.g. "(10/10) "
+const splitNumberingLength = 8
+
+// Tell whether text can be sent in the GSM-7 encoding, otherwise it is sent in UCS-2
+func isGSM(text string) bool {
+	for _, char := range text {
+		if !strings.ContainsRune(gsmBasic, char) && !strings.ContainsRune(gsmExtended, char) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get how many characters char takes in a message using the GSM-7 encoding or not
+func charLength(char rune, gsm bool) int {
+	if gsm {
+		if strings.ContainsRune(gsmExtended, char) {
+			return 2
+		}
+		return 1
+	}
+	// UCS-2 needs two characters for the ones beyond the basic multilingual plane, like emojis
+	if char > 0xFFFF {
+		return 2
+	}
+	return 1
+}
+
+// Get the length of text as SMS count it, roughly
+func messageLength(text string) int {
+	gsm := isGSM(text)
+	length := 0
+	for _, char := range text {
+		length += charLength(char, gsm)
+	}
+	return length
+}
+
+// Get the longest prefix of text fitting in length characters, in the given encoding
+func fittingPrefix(text string, length int, gsm bool) string {
+	used := 0
+	for i, char := range text {
+		used += charLength(char, gsm)
+		if used > length {
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// Split text into numbered parts of length characters at most e.g. "(1/2) ...", preferably between words,
+// leaving reserved characters free in each part for what is added to it when sending
+func splitMessage(text string, length int, reserved int) []string {
+	if messageLength(text)+reserved <= length {
+		return []string{text}
+	}
+
+	gsm := isGSM(text)
+	room := length - splitNumberingLength - reserved
+	var chunks []string
+	for text != "" {
+		// Whatever does not fit in the last part is cut
+		if len(chunks) == maxSplitParts-1 {
+			chunks = append(chunks, truncate(strings.TrimSpace(text), room))
+			break
+		}
+		chunk := fittingPrefix(text, room, gsm)
+		if chunk == "" {
+			break
+		}
+		if len(chunk) < len(text) {
+			if space := strings.LastIndexAny(chunk, " \n"); space > len(chunk)/2 {
+				chunk = chunk[:space+1]
+			}
+		}
+		chunks = append(chunks, strings.TrimSpace(chunk))
+		text = text[len(chunk):]
+	}
+
+	parts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		parts[i] = fmt.Sprintf("(%d/%d) %s", i+1, len(chunks), chunk)
+	}
+	return parts
+}
+
+// Get how long the message of delivery may be, split messages spanning several SMS,
+// leaving room for the prefix and suffix added to each of them when sending
+func (serv *Server) messageRoom(delivery Delivery) int {
+	reserved := messageLength(serv.withDeployment(""))
+	if serv.splitMode == "split" {
+		return (delivery.MaxLength - splitNumberingLength - reserved) * maxSplitParts
+	}
+	return delivery.MaxLength - reserved
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/prometheus/alertmanager/template"
+)
+
+// Label selecting the spreadsheet an alert's teams are read from, when several are set
+const spreadsheetLabel = "env"
+
+// A spreadsheet teams are read from, Env being empty for the one of alerts without a known env label
+type Spreadsheet struct {
+	Env string
+	Id  string
+}
+
+// Parse GOOGLE_SHEET_ID, a spreadsheet ID or a list of env=ID entries, the default spreadsheet coming first
+func parseSpreadsheets(value string) ([]Spreadsheet, error) {
+	var spreadsheets []Spreadsheet
+	defaults := 0
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		var spreadsheet Spreadsheet
+		if separator := strings.Index(entry, "="); separator >= 0 {
+			spreadsheet.Env = strings.ToLower(strings.TrimSpace(entry[:separator]))
+			entry = strings.TrimSpace(entry[separator+1:])
+			if spreadsheet.Env == "" {
+				return nil, errors.New(fmt.Sprintf("Spreadsheet %s has an empty env", entry))
+			}
+		}
+		if !regexpSheetId.MatchString(entry) {
+			return nil, errors.New(fmt.Sprintf("Invalid spreadsheet ID \"%s\"", entry))
+		}
+		spreadsheet.Id = entry
+		for _, existing := range spreadsheets {
+			if existing.Env == spreadsheet.Env {
+				return nil, errors.New(fmt.Sprintf("Several spreadsheets for env \"%s\"", spreadsheet.Env))
+			}
+		}
+		if spreadsheet.Env == "" {
+			defaults++
+			spreadsheets = append([]Spreadsheet{spreadsheet}, spreadsheets...)
+			continue
+		}
+		spreadsheets = append(spreadsheets, spreadsheet)
+	}
+	if defaults > 1 {
+		return nil, errors.New("Only one spreadsheet may have no env")
+	}
+	return spreadsheets, nil
+}
+
+// Get the spreadsheet of an env, the default one when env has none
+func (serv *Server) spreadsheet(env string) Spreadsheet {
+	env = strings.ToLower(strings.TrimSpace(env))
+	for _, spreadsheet := range serv.spreadsheets {
+		if spreadsheet.Env == env {
+			return spreadsheet
+		}
+	}
+	return serv.spreadsheets[0]
+}
+
+// Get the spreadsheet an alert's teams are read from, selected by its env label
+func (serv *Server) alertSpreadsheet(alert template.Alert) Spreadsheet {
+	env := alert.Labels[spreadsheetLabel]
+	spreadsheet := serv.spreadsheet(env)
+	if env != "" && len(serv.spreadsheets) > 1 && spreadsheet.Env != strings.ToLower(strings.TrimSpace(env)) {
+		log.Printf("No spreadsheet for env \"%s\" of alert %s, reading teams from the default one", env, alert.Labels["alertname"])
+	}
+	return spreadsheet
+}
+
+// Get the key a team of the spreadsheet is cached under, teams of different envs being cached apart
+func (spreadsheet Spreadsheet) teamKey(key string) string {
+	if spreadsheet.Env == "" {
+		return key
+	}
+	return spreadsheet.Env + "/" + key
+}
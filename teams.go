@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// What the service currently knows of a team, straight from the caches
+type TeamListing struct {
+	Recipients []string `json:"recipients"`
+	// Cells that are not usable phone numbers, along with why
+	Invalid []string `json:"invalid,omitempty"`
+	// "cache" for teams read from the Sheet lately, "fallback" for the ones only left in the fallback cache
+	Source string `json:"source"`
+}
+
+// List the known teams and their recipients, or only the team given by the team query parameter,
+// phone numbers being masked unless the unmasked query parameter is true
+func (serv *Server) teams(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet {
+		asJson(w, http.StatusMethodNotAllowed, "unsupported HTTP method")
+		return
+	}
+
+	if _, ok := serv.readManagementBody(w, r); !ok {
+		return
+	}
+
+	mask := !parseBool(r.URL.Query().Get("unmasked"), false)
+	listings := serv.knownTeams(mask)
+
+	team := r.URL.Query().Get("team")
+	if team == "" {
+		asJson(w, http.StatusOK, listings)
+		return
+	}
+	listing, found := listings[serv.teamKey(team)]
+	if !found {
+		asJson(w, http.StatusNotFound, fmt.Sprintf("No known numbers for team %s", team))
+		return
+	}
+	asJson(w, http.StatusOK, map[string]TeamListing{serv.teamKey(team): listing})
+}
+
+// Get the listings of the teams of both caches, the recent ones taking precedence over the fallback ones
+func (serv *Server) knownTeams(mask bool) map[string]TeamListing {
+	listings := make(map[string]TeamListing)
+	serv.listTeams(listings, serv.longCache, "fallback", mask)
+	serv.listTeams(listings, serv.shortCache, "cache", mask)
+	return listings
+}
+
+// Add the teams of a cache to the listings, replacing the ones listed from another cache
+func (serv *Server) listTeams(listings map[string]TeamListing, teams *cache.Cache, source string, mask bool) {
+	for name, item := range teams.Items() {
+		listing := TeamListing{Recipients: []string{}, Source: source}
+		for _, recipient := range item.Object.(Team).Numbers {
+			number := strings.TrimSpace(fmt.Sprint(recipient))
+			if number == "" {
+				continue
+			}
+			to, err := serv.formatNumber(number)
+			if err != nil && mask {
+				listing.Invalid = append(listing.Invalid, fmt.Sprintf("Invalid phone number %s", maskPhone(number)))
+				continue
+			}
+			if err != nil {
+				listing.Invalid = append(listing.Invalid, err.Error())
+				continue
+			}
+			listing.Recipients = appendUnique(listing.Recipients, to)
+		}
+		if mask {
+			for i, to := range listing.Recipients {
+				listing.Recipients[i] = maskPhone(to)
+			}
+		}
+		listings[name] = listing
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Label selecting the escalation tier, i.e. the named columns, an alert is sent to
+const tierLabel = "escalation"
+
+// Read the names given to the columns by the header row, by column index
+func (serv *Server) readHeader(ctx context.Context, service *sheets.Service, spreadsheetId string) (map[int]string, error) {
+	resp, err := service.Spreadsheets.Values.Get(spreadsheetId, serv.headerRange()).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int]string)
+	if len(resp.Values) > 0 {
+		for i, value := range resp.Values[0] {
+			if name := strings.ToLower(strings.TrimSpace(fmt.Sprint(value))); name != "" {
+				names[serv.sheetRange.FirstColumn+i] = name
+			}
+		}
+	}
+	return names, nil
+}
+
+// Group a team's phone numbers by the names of their columns, in the columns' order
+func teamTiers(team Team, header map[int]string) map[string][]interface{} {
+	if len(header) == 0 {
+		return nil
+	}
+
+	columns := make([]int, 0, len(team.Columns))
+	for column := range team.Columns {
+		columns = append(columns, column)
+	}
+	sort.Ints(columns)
+
+	tiers := make(map[string][]interface{})
+	for _, column := range columns {
+		if name, found := header[column]; found {
+			tiers[name] = append(tiers[name], team.Columns[column])
+		}
+	}
+	return tiers
+}
+
+// Get the team's phone numbers of an escalation tier, numbers being the ones used when the team has no such tier
+func (serv *Server) tierNumbers(name string, team Team, tier string, numbers []interface{}) []interface{} {
+	if serv.headerRow <= 0 {
+		return numbers
+	}
+	if tierNumbers, found := team.Tiers[strings.ToLower(strings.TrimSpace(tier))]; found {
+		log.Printf("Sending to the %s tier of team %s", tier, name)
+		return tierNumbers
+	}
+	logMessage(fmt.Sprintf("Team %s has no %s tier, sending to its other numbers", name, tier))
+	return numbers
+}
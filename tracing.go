@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Record each request handled by handler as a Sentry transaction, when tracing is enabled
+func traced(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !usingSentry() || sentry.CurrentHub().Client().Options().TracesSampleRate == 0 {
+			handler(w, r)
+			return
+		}
+
+		// Each request gets its own hub, transaction names are set on the hub's scope
+		ctx := sentry.SetHubOnContext(r.Context(), sentry.CurrentHub().Clone())
+		transaction := sentry.StartSpan(ctx, "http.server", sentry.TransactionName(name), sentry.ContinueFromRequest(r))
+		defer transaction.Finish()
+		handler(w, r.WithContext(transaction.Context()))
+	}
+}
+
+// A context cancelled along with another, e.g. the service's, that carries the values of the request's
+type detachedContext struct {
+	context.Context
+	request context.Context
+}
+
+func (ctx detachedContext) Value(key interface{}) interface{} {
+	if value := ctx.request.Value(key); value != nil {
+		return value
+	}
+	return ctx.Context.Value(key)
+}
+
+// Get a context done when parent is rather than with the request of ctx, work outliving the request
+// still being traced in the request's Sentry transaction
+func withRequestSpan(parent context.Context, ctx context.Context) context.Context {
+	if sentry.TransactionFromContext(ctx) == nil {
+		return parent
+	}
+	return detachedContext{parent, ctx}
+}
+
+// Start a span of the transaction of ctx around an external call, nil when there is no transaction
+func startSpan(ctx context.Context, operation string, description string) *sentry.Span {
+	if sentry.TransactionFromContext(ctx) == nil {
+		return nil
+	}
+	span := sentry.StartSpan(ctx, operation)
+	span.Description = description
+	return span
+}
+
+func finishSpan(span *sentry.Span) {
+	if span != nil {
+		span.Finish()
+	}
+}
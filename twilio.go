@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Where twilio's REST API is reached unless TWILIO_API_BASE_URL is set
+const defaultTwilioApiBaseUrl = "https://api.twilio.com"
+
+// Where twilio Lookup is reached unless TWILIO_LOOKUP_BASE_URL is set
+const defaultTwilioLookupBaseUrl = "https://lookups.twilio.com"
+
+// Twilio error codes telling that the account's sending queue or throughput is saturated
+var twilioQueueCodes = map[int]bool{
+	20429: true, // Too many requests
+	30001: true, // Queue overflow
+	30022: true, // US A2P 10DLC rate limits exceeded
+	14107: true, // SMS send rate limit exceeded
+}
+
+// Twilio error codes telling that the credentials are wrong
+var twilioAuthCodes = map[int]bool{
+	20003: true, // Authentication failed
+	20005: true, // Account not active
+}
+
+// Twilio error codes telling that the sender, rather than the message or recipient, is the problem
+var twilioSenderCodes = map[int]bool{
+	14107: true, // SMS send rate limit exceeded
+	21606: true, // From number is not a valid, SMS-capable phone number
+	21611: true, // From number has too many queued messages
+	21659: true, // From number is not a twilio phone number
+	21660: true, // From number does not belong to the account
+}
+
+// HTTP statuses telling that twilio, or the notification webhook, may accept the same request later
+var retryStatuses = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// A non-2xx response from the twilio API
+type TwilioError struct {
+	Status     string
+	StatusCode int
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+	MoreInfo   string `json:"more_info"`
+	Body       string `json:"-"`
+	// How long twilio asks to wait before trying again, 0 when it does not say
+	RetryAfter time.Duration
+}
+
+func newTwilioError(resp *http.Response, body []byte) *TwilioError {
+	twilioErr := &TwilioError{Status: resp.Status, StatusCode: resp.StatusCode, Body: string(body)}
+	_ = json.Unmarshal(body, twilioErr)
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		twilioErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return twilioErr
+}
+
+func (e *TwilioError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("Non-200 response from twilio API: %s - %s", e.Status, e.Body)
+	}
+	return fmt.Sprintf("Twilio error %d (%s): %s", e.Code, e.Status, e.Message)
+}
+
+// Classify the error as "queue" when twilio is saturated, "auth" for credentials errors or "other"
+func (e *TwilioError) Kind() string {
+	if twilioQueueCodes[e.Code] {
+		return "queue"
+	}
+	if twilioAuthCodes[e.Code] {
+		return "auth"
+	}
+	return "other"
+}
+
+// Tell whether err comes from the sender, another sender possibly succeeding
+func senderError(err error) bool {
+	twilioErr, ok := err.(*TwilioError)
+	return ok && twilioSenderCodes[twilioErr.Code]
+}
+
+// Tell whether sending again may succeed, and how long to wait before the given retry attempt
+func retryDelay(err error, attempt int, baseDelay time.Duration) (time.Duration, bool) {
+	switch e := err.(type) {
+	case *TwilioError:
+		if !retryStatuses[e.StatusCode] && e.Kind() != "queue" {
+			return 0, false
+		}
+		if e.RetryAfter > 0 {
+			return e.RetryAfter, true
+		}
+	case *url.Error:
+		// Network errors, twilio could not be reached
+	case interface{ Temporary() bool }:
+		// Email and notification webhook errors tell whether they may go away
+		if !e.Temporary() {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	// Exponential backoff, with jitter so that concurrent sends do not retry all at once
+	delay := baseDelay << uint(attempt)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)), true
+}
+
+// Tell whether number is one of the account's phone numbers
+func ownsNumber(client *http.Client, twilio TwilioCredentials, number string) (bool, error) {
+	urlStr := fmt.Sprintf("%s/2010-04-01/Accounts/%s/IncomingPhoneNumbers.json?PhoneNumber=%s", twilio.ApiBaseUrl, twilio.AccountSid, url.QueryEscape(number))
+	req, _ := http.NewRequest("GET", urlStr, nil)
+	req.SetBasicAuth(twilio.AuthSid, twilio.AuthToken)
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, newTwilioError(resp, body)
+	}
+
+	var data struct {
+		Numbers []struct {
+			PhoneNumber string `json:"phone_number"`
+		} `json:"incoming_phone_numbers"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return false, err
+	}
+	return len(data.Numbers) > 0, nil
+}
+
+// Check that the senders belong to the twilio account, failing at startup rather than at the first page when strict
+func (serv *Server) checkSenders(strict bool) {
+	for _, number := range serv.fromNumbers {
+		owned, err := ownsNumber(serv.twilioClient, serv.twilio, number)
+		message := ""
+		if err != nil {
+			message = fmt.Sprintf("Cannot check sender %s with twilio: %s", number, err.Error())
+		} else if !owned {
+			message = fmt.Sprintf("Sender %s is not a phone number of twilio account %s, check TWILIO_FROM_NUMBER", number, serv.twilio.AccountSid)
+		}
+		if message == "" {
+			log.Printf("Sender %s belongs to the twilio account", number)
+			continue
+		}
+		if strict {
+			log.Fatal(message)
+		}
+		logMessage(message)
+	}
+}
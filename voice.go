@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/alertmanager/template"
+)
+
+// Severities calling recipients on top of sending them SMS, when voice calls are enabled
+const defaultVoiceSeverities = "critical"
+
+// Tell whether an alert calls its recipients on top of SMS, the voice_call label overriding its severity
+func (serv *Server) wantsCall(alert template.Alert) bool {
+	if !serv.voiceEnabled || alert.Status != "firing" {
+		return false
+	}
+	if label, found := alert.Labels["voice_call"]; found {
+		if call, err := strconv.ParseBool(strings.TrimSpace(label)); err == nil {
+			return call
+		}
+		log.Printf("Ignoring invalid voice_call label \"%s\" of alert %s", label, alert.Labels["alertname"])
+	}
+	return contains(serv.voiceSeverities, alert.Labels["severity"])
+}
+
+// Get the TwiML reading message out loud
+func sayTwiml(message string) string {
+	var escaped bytes.Buffer
+	_ = xml.EscapeText(&escaped, []byte(message))
+	return fmt.Sprintf("<Response><Say>%s</Say></Response>", escaped.String())
+}
+
+// Call recipient through twilio, reading message out loud or playing the TwiML found at twimlUrl when set
+func sendCall(ctx context.Context, client *http.Client, twilio TwilioCredentials, recipient string, message string, twimlUrl string) (string, error) {
+	log.Printf("Calling %s: %s", recipient, message)
+
+	urlStr := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Calls.json", twilio.ApiBaseUrl, twilio.AccountSid)
+	callData := url.Values{}
+	callData.Set("To", recipient)
+	callData.Set("From", twilio.FromNumber)
+	if twimlUrl != "" {
+		callData.Set("Url", twimlUrl)
+	} else {
+		callData.Set("Twiml", sayTwiml(message))
+	}
+	callDataReader := *strings.NewReader(callData.Encode())
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", urlStr, &callDataReader)
+	req.SetBasicAuth(twilio.AuthSid, twilio.AuthToken)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		log.Printf("Error querying twilio API: %s", err.Error())
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("Error response from twilio API: %s", body)
+		return "", newTwilioError(resp, body)
+	}
+
+	var data map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		log.Printf("Error in twilio response body: %s", err.Error())
+		return "", err
+	}
+	sid, _ := data["sid"].(string)
+	log.Printf("Successfully placed call - SID %s", sid)
+	return sid, nil
+}
+
+// Call recipient through twilio, retrying like SMS
+func (serv *Server) call(ctx context.Context, recipient string, message string) (string, error) {
+	if serv.dryRun {
+		log.Printf("DRY RUN - not calling %s: %s", recipient, message)
+		return "", nil
+	}
+	defer finishSpan(startSpan(ctx, "twilio.call", maskPhone(recipient)))
+	sid, err := serv.withRetries(ctx, "call", "Calling", recipient, func(client *http.Client) (string, error) {
+		return sendCall(ctx, client, serv.twilio, recipient, message, serv.voiceTwimlUrl)
+	})
+	if err != nil {
+		callsFailed.WithLabelValues(failureReason(err)).Inc()
+		return sid, err
+	}
+	callsPlaced.Inc()
+	return sid, nil
+}
+
+// Call recipient on top of the SMS sent for the delivery, returns whether the call was placed
+func (serv *Server) callToo(ctx context.Context, delivery Delivery, recipient string) bool {
+	delivery.Channel = "call"
+	sid, err := serv.call(ctx, recipient, serv.withDeployment(delivery.Message))
+	serv.audit.record(delivery, recipient, sid, err)
+	serv.health.sendDone(err)
+	if err != nil {
+		logError(fmt.Sprintf("Cannot call %s: %s", maskPhone(recipient), err.Error()), err, delivery)
+		return false
+	}
+	return true
+}